@@ -0,0 +1,95 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// ID allocator module
+
+package kscdb
+
+import "sync"
+
+// IDAllocator hands out IDs of key from blocks reserved with IDs Reserve. It
+// prefetches next block in background when half of current block is used,
+// so most IDs are returned without database requests. IDs of not used
+// blocks are lost when the process stops, so IDs may have gaps, but never
+// duplicates. It is safe for concurrent use.
+type IDAllocator struct {
+	cdb   *Kscdb
+	key   string
+	block int64
+
+	mu    sync.Mutex
+	next  int64         // Next ID of current block
+	last  int64         // Last ID of current block
+	ahead *idBlock      // Prefetched block
+	fetch chan struct{} // Closed when prefetch done, nil if not fetching
+	err   error         // Last prefetch error
+}
+
+// idBlock is reserved IDs range
+type idBlock struct {
+	first, last int64
+}
+
+// IDAllocator creates ID allocator of key which reserves block IDs at once
+func (cdb *Kscdb) IDAllocator(key string, block int64) *IDAllocator {
+	if block <= 0 {
+		block = 1
+	}
+	return &IDAllocator{cdb: cdb, key: key, block: block, next: 1}
+}
+
+// Next returns next ID. It waits for reserving of next block if current
+// block is used.
+func (a *IDAllocator) Next() (id int64, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Get next block if current block is used
+	for a.next > a.last {
+		if a.ahead != nil {
+			a.next, a.last = a.ahead.first, a.ahead.last
+			a.ahead = nil
+			break
+		}
+		if a.fetch == nil {
+			a.prefetch()
+		}
+		fetch := a.fetch
+		a.mu.Unlock()
+		<-fetch
+		a.mu.Lock()
+		if a.ahead == nil && a.err != nil {
+			err = a.err
+			return
+		}
+	}
+
+	id = a.next
+	a.next++
+
+	// Prefetch next block when half of current block is used
+	if a.ahead == nil && a.fetch == nil && a.last-a.next < a.block/2 {
+		a.prefetch()
+	}
+	return
+}
+
+// prefetch starts reserving of next block in background, the a.mu should be
+// locked
+func (a *IDAllocator) prefetch() {
+	fetch := make(chan struct{})
+	a.fetch = fetch
+	go func() {
+		first, last, err := a.cdb.ID.Reserve(a.key, a.block)
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if err == nil {
+			a.ahead = &idBlock{first, last}
+		}
+		a.err = err
+		a.fetch = nil
+		close(fetch)
+	}()
+}
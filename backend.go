@@ -0,0 +1,298 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Storage backend module
+
+package kscdb
+
+import (
+	"context"
+	"time"
+)
+
+// Backend is kscdb storage backend. It contains storage primitives used by
+// Map, IDs, Queue and Lock. Backend methods should return ErrNotFound if
+// requested record does not exists. Use LockInfo Live, LivePermits,
+// AvailableRecords and QueueRecord Less to apply locks expiration, queue
+// order and availability rules in backend implementation.
+type Backend interface {
+
+	// Get returns map value by key
+	Get(ctx context.Context, key string) (data []byte, err error)
+
+	// Set sets map value by key
+	Set(ctx context.Context, key string, value []byte) error
+
+	// SetFenced sets map value by key and saves fencing token with it if the
+	// token is not older than the token saved with the value. The token is
+	// checked and saved atomically with the value. Returns false if the
+	// token is older.
+	SetFenced(ctx context.Context, key string, value []byte, token int64) (ok bool, err error)
+
+	// Delete removes map record by key
+	Delete(ctx context.Context, key string) error
+
+	// Scan returns map records with keys from >= key < to
+	Scan(ctx context.Context, from, to string) (items []KeyValue, err error)
+
+	// GetID returns next ID value by key
+	GetID(ctx context.Context, key string) (nextID int64, err error)
+
+	// SetID sets next ID value by key
+	SetID(ctx context.Context, key string, nextID int64) error
+
+	// ListIDs returns IDs with keys from >= key < to
+	ListIDs(ctx context.Context, from, to string) (ids []IDInfo, err error)
+
+	// CompareAndSetID sets next ID value by key to next if it equal to old,
+	// the old 0 means ID does not exists. Returns false and current next ID
+	// value (0 if ID does not exists) if the value was not set.
+	CompareAndSetID(ctx context.Context, key string, old, next int64) (ok bool, current int64, err error)
+
+	// DeleteID removes ID by key
+	DeleteID(ctx context.Context, key string) error
+
+	// GetLock returns lock record by key
+	GetLock(ctx context.Context, key string) (info LockInfo, err error)
+
+	// AcquireLock sets lock record holder if the lock has not holder. The
+	// holder expires at info Expires, it never expires if Expires is zero.
+	// The lock readers are not changed. Returns true if the holder was set.
+	AcquireLock(ctx context.Context, info LockInfo) (ok bool, err error)
+
+	// RenewLock updates lock record and its expiration if the record holder
+	// equal to info Holder. Returns true if the record was updated.
+	RenewLock(ctx context.Context, info LockInfo) (ok bool, err error)
+
+	// ReleaseLock removes lock record holder if it equal to holder, or
+	// removes lock record with its holder and readers if holder is empty.
+	// Returns true if the holder was removed.
+	ReleaseLock(ctx context.Context, key, holder string) (ok bool, err error)
+
+	// AcquireReader adds reader which expires at expires to the lock record
+	// if the lock has not holder. Returns true if the reader was added.
+	AcquireReader(ctx context.Context, key, reader string, expires time.Time) (ok bool, err error)
+
+	// ReleaseReader removes reader from the lock record
+	ReleaseReader(ctx context.Context, key, reader string) error
+
+	// ListLocks returns lock records with keys from >= key < to
+	ListLocks(ctx context.Context, from, to string) (locks []LockInfo, err error)
+
+	// AcquirePermit adds holder which expires at expires to the semaphore
+	// permits if number of not expired holders less than capacity. Returns
+	// true if the holder was added.
+	AcquirePermit(ctx context.Context, key, holder string, capacity int, expires time.Time) (ok bool, err error)
+
+	// RenewPermit updates semaphore holder expiration if the holder is not
+	// expired. Returns false if the holder not found.
+	RenewPermit(ctx context.Context, key, holder string, expires time.Time) (ok bool, err error)
+
+	// ReleasePermit removes holder from the semaphore permits
+	ReleasePermit(ctx context.Context, key, holder string) error
+
+	// NextFence increments and returns fencing token of lock key
+	NextFence(ctx context.Context, key string) (token int64, err error)
+
+	// Append adds record to named queue with its lock, data and number of
+	// receives. Records are ordered by priority from highest, then by time.
+	// The backend sets current time if record time is zero, it should use
+	// the same clock which Available uses to check records time.
+	Append(ctx context.Context, key string, rec QueueRecord) error
+
+	// AppendBatch adds records to named queue, see Append
+	AppendBatch(ctx context.Context, key string, recs []QueueRecord) error
+
+	// AppendFenced adds records to named queue and saves fencing token of
+	// the queue if the token is not older than saved one, see Append. The
+	// token is checked atomically with every record write. Returns false if
+	// the token is older.
+	AppendFenced(ctx context.Context, key string, recs []QueueRecord, token int64) (ok bool, err error)
+
+	// Available returns up to n first available records of named queue:
+	// records with passed time, not locked or locked with passed visibility
+	// time. If maxWait is set and the oldest available record waits longer
+	// than maxWait it is returned first.
+	Available(ctx context.Context, key string, n int, maxWait time.Duration) (recs []QueueRecord, err error)
+
+	// Count returns number of named queue records, or number of records
+	// with time in the future if scheduled is true
+	Count(ctx context.Context, key string, scheduled bool) (n int64, err error)
+
+	// Records returns limit records of named queue in queue order, including
+	// locked records, starting from cursor returned by previous call or from
+	// first record if cursor is nil. Returns next cursor, or nil if there
+	// are no more records. Returns all records if limit is 0.
+	Records(ctx context.Context, key string, cursor []byte, limit int) (recs []QueueRecord, next []byte, err error)
+
+	// LockRecord sets lock, visibility time and number of receives of named
+	// queue record if the record lock equal to rec Lock. Returns false if the record not found
+	// or its lock was changed.
+	LockRecord(ctx context.Context, key string, rec QueueRecord, lock string, visible time.Time, receives int) (ok bool, err error)
+
+	// Remove removes record from named queue if the record lock equal to
+	// rec Lock. Returns false if the record not found or its lock was
+	// changed.
+	Remove(ctx context.Context, key string, rec QueueRecord) (ok bool, err error)
+
+	// Clear removes all records from named queue
+	Clear(ctx context.Context, key string) error
+
+	// Close closes backend
+	Close()
+}
+
+// KeyValue is map record
+type KeyValue struct {
+	Key  string
+	Data []byte
+}
+
+// IDInfo is ID record
+type IDInfo struct {
+	Key    string // ID key
+	NextID int64  // Next ID value
+}
+
+// LockInfo is lock record
+type LockInfo struct {
+	Key      string    // Lock key
+	Holder   string    // Lock holder id (lockid)
+	Owner    string    // Lock owner, see Kscdb.Owner
+	Acquired time.Time // Time acquired
+	Expires  time.Time // Expiration time, zero if never expires
+
+	// Readers holder ids with its expiration time, zero if never expires
+	Readers map[string]time.Time
+}
+
+// Live returns lock record without expired holder and readers at now, the
+// ok is false if nothing left. Backends use it to read lock records.
+func (i LockInfo) Live(now time.Time) (info LockInfo, ok bool) {
+	info = i
+	if expired(i.Expires, now) {
+		info.Holder, info.Owner = "", ""
+		info.Acquired, info.Expires = time.Time{}, time.Time{}
+	}
+	info.Readers = nil
+	for reader, expires := range i.Readers {
+		if expired(expires, now) {
+			continue
+		}
+		if info.Readers == nil {
+			info.Readers = make(map[string]time.Time)
+		}
+		info.Readers[reader] = expires
+	}
+	ok = info.Holder != "" || len(info.Readers) > 0
+	return
+}
+
+// LivePermits returns not expired semaphore holders at now. Backends use it
+// to count semaphore permits.
+func LivePermits(holders map[string]time.Time, now time.Time) (live map[string]time.Time) {
+	live = make(map[string]time.Time, len(holders))
+	for holder, expires := range holders {
+		if !expired(expires, now) {
+			live[holder] = expires
+		}
+	}
+	return
+}
+
+// AvailableRecords finds first available records of named queue, see
+// Backend Available. Backends add queue records to it in queue order until
+// Add returns true, then get found records with Result.
+type AvailableRecords struct {
+	now     time.Time
+	n       int
+	maxWait time.Duration
+	recs    []QueueRecord // First available records
+	oldest  *QueueRecord  // Oldest available record
+}
+
+// NewAvailableRecords creates AvailableRecords which finds up to n first
+// available records at now with starvation protection maxWait
+func NewAvailableRecords(now time.Time, n int, maxWait time.Duration) *AvailableRecords {
+	return &AvailableRecords{now: now, n: n, maxWait: maxWait}
+}
+
+// Add adds record, it returns true if records are found and next records
+// are not needed
+func (a *AvailableRecords) Add(rec QueueRecord) (done bool) {
+	if rec.Time.After(a.now) || !rec.Available(a.now) {
+		return
+	}
+	if len(a.recs) < a.n {
+		a.recs = append(a.recs, rec)
+	}
+	if a.oldest == nil || rec.Time.Before(a.oldest.Time) {
+		a.oldest = &rec
+	}
+	return a.maxWait <= 0 && a.Full()
+}
+
+// Full reports whether n first available records are found. Next records
+// are still needed to find the oldest record if maxWait is set.
+func (a *AvailableRecords) Full() bool {
+	return len(a.recs) >= a.n
+}
+
+// Result returns found records, the oldest record goes first if it waits
+// longer than maxWait
+func (a *AvailableRecords) Result() (recs []QueueRecord) {
+	if a.maxWait <= 0 || a.oldest == nil || a.now.Sub(a.oldest.Time) <= a.maxWait {
+		return a.recs
+	}
+	recs = append(recs, *a.oldest)
+	for _, rec := range a.recs {
+		if len(recs) >= a.n {
+			break
+		}
+		if rec.Priority == a.oldest.Priority && rec.Time.Equal(a.oldest.Time) &&
+			rec.Random == a.oldest.Random {
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	return
+}
+
+// expired reports whether expiration time expires passed at now
+func expired(expires, now time.Time) bool {
+	return !expires.IsZero() && !now.Before(expires)
+}
+
+// QueueRecord is named queue record
+type QueueRecord struct {
+	Priority int       // Priority, records with higher priority go first
+	Time     time.Time // Time added or scheduled delivery time
+	Random   string    // Random tie-breaker
+	Lock     string    // Lock state, receipt id of received record
+	Data     []byte    // Record data
+
+	// Visibility time of locked record, the record is available again at
+	// this time. The locked record is never available if it is zero.
+	Visible time.Time
+
+	Receives int // Number of receives
+}
+
+// Available reports whether the record is not locked or its visibility
+// time passed at now
+func (r QueueRecord) Available(now time.Time) bool {
+	return r.Lock == "" || (!r.Visible.IsZero() && !now.Before(r.Visible))
+}
+
+// Less reports whether the record r sorts before the record rec in the
+// named queue: by priority from highest, then by time and tie-breaker
+func (r QueueRecord) Less(rec QueueRecord) bool {
+	if r.Priority != rec.Priority {
+		return r.Priority > rec.Priority
+	}
+	if !r.Time.Equal(rec.Time) {
+		return r.Time.Before(rec.Time)
+	}
+	return r.Random < rec.Random
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Storage backend helpers tests
+
+package kscdb
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestLockInfoLive(t *testing.T) {
+	now := time.Now()
+	info := LockInfo{Key: "/test/lock", Holder: "a", Expires: now,
+		Readers: map[string]time.Time{"b": now.Add(time.Second), "c": now}}
+
+	live, ok := info.Live(now)
+	if !ok || live.Holder != "" || len(live.Readers) != 1 {
+		t.Fatalf("live %+v, %v, want reader b only", live, ok)
+	}
+	if _, ok = info.Live(now.Add(time.Second)); ok {
+		t.Fatal("expired lock is live")
+	}
+	if live := LivePermits(info.Readers, now); len(live) != 1 {
+		t.Fatalf("%d live permits, want 1", len(live))
+	}
+}
+
+func TestQueueRecordLess(t *testing.T) {
+	now := time.Now()
+	recs := []QueueRecord{
+		{Priority: 0, Time: now, Random: "b"},
+		{Priority: 0, Time: now.Add(-time.Second), Random: "c"},
+		{Priority: 1, Time: now, Random: "d"},
+		{Priority: 0, Time: now, Random: "a"},
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Less(recs[j]) })
+	var order string
+	for _, rec := range recs {
+		order += rec.Random
+	}
+	if order != "dcab" {
+		t.Fatalf("queue order %s, want dcab", order)
+	}
+}
+
+func TestAvailableRecords(t *testing.T) {
+	now := time.Now()
+	recs := []QueueRecord{
+		{Priority: 1, Time: now, Random: "a"},
+		{Priority: 1, Time: now, Random: "b", Lock: "receipt"},
+		{Priority: 1, Time: now.Add(time.Second), Random: "c"},
+		{Priority: 0, Time: now.Add(-time.Minute), Random: "d"},
+	}
+
+	// add adds records in queue order and returns found records ids
+	add := func(a *AvailableRecords) (ids string) {
+		for _, rec := range recs {
+			if a.Add(rec) {
+				break
+			}
+		}
+		for _, rec := range a.Result() {
+			ids += rec.Random
+		}
+		return
+	}
+	if ids := add(NewAvailableRecords(now, 2, 0)); ids != "ad" {
+		t.Fatalf("available %s, want ad", ids)
+	}
+	if ids := add(NewAvailableRecords(now, 1, 0)); ids != "a" {
+		t.Fatalf("available %s, want a", ids)
+	}
+
+	// The oldest record waits longer than maxWait
+	if ids := add(NewAvailableRecords(now, 1, time.Second)); ids != "d" {
+		t.Fatalf("available %s, want starving d", ids)
+	}
+}
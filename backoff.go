@@ -0,0 +1,75 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Retry backoff module
+
+package kscdb
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// DefaultBackoff is default lock acquisition backoff
+var DefaultBackoff = Backoff{Min: 10 * time.Millisecond, Max: time.Second}
+
+// DefaultPollBackoff is default empty queue polling backoff
+var DefaultPollBackoff = Backoff{Min: 50 * time.Millisecond, Max: 5 * time.Second}
+
+// Backoff define exponential backoff with jitter used between retries
+type Backoff struct {
+	Min         time.Duration // Delay before second attempt
+	Max         time.Duration // Maximum delay, unlimited if 0
+	MaxAttempts int           // Maximum number of attempts, unlimited if 0
+}
+
+// maxDelay is maximum delay of backoff without Max
+const maxDelay = time.Duration(math.MaxInt64 / 2)
+
+// Delay returns delay before attempt number attempt + 1. The delay doubles
+// with every attempt up to Max, or without limit if Max is 0, and randomized
+// in range [delay/2, delay).
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := b.Min
+	for i := 1; i < attempt && (b.Max <= 0 || delay < b.Max) &&
+		delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// withDefaults returns backoff with Min and Max taken from defaults if they
+// are not set, the Max taken from defaults is not less than Min
+func (b Backoff) withDefaults(defaults Backoff) Backoff {
+	if b.Min <= 0 {
+		b.Min = defaults.Min
+	}
+	if b.Max <= 0 {
+		b.Max = defaults.Max
+		if b.Max < b.Min {
+			b.Max = b.Min
+		}
+	}
+	return b
+}
+
+// Wait waits delay before attempt number attempt + 1 or until ctx is done
+func (b Backoff) Wait(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(b.Delay(attempt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
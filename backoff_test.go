@@ -0,0 +1,63 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Retry backoff tests
+
+package kscdb
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Min: 10 * time.Millisecond, Max: 40 * time.Millisecond}
+	for i, max := range []time.Duration{10, 20, 40, 40, 40} {
+		max *= time.Millisecond
+		if delay := b.Delay(i + 1); delay < max/2 || delay >= max {
+			t.Fatalf("attempt %d delay %v, want in [%v, %v)", i+1, delay,
+				max/2, max)
+		}
+	}
+}
+
+func TestBackoffWithoutMax(t *testing.T) {
+	b := Backoff{Min: 10 * time.Millisecond, MaxAttempts: 5}
+	if delay := b.Delay(4); delay < 40*time.Millisecond {
+		t.Fatalf("delay %v without Max, want at least 40ms", delay)
+	}
+	if delay := b.Delay(1000); delay <= 0 {
+		t.Fatalf("delay %v of attempt 1000, want positive", delay)
+	}
+}
+
+func TestBackoffOptions(t *testing.T) {
+	opts := Options{
+		Path:        filepath.Join(t.TempDir(), "kscdb.log"),
+		LockBackoff: Backoff{Min: 10 * time.Millisecond, MaxAttempts: 5},
+		PollBackoff: Backoff{Max: time.Second},
+	}
+	cdb, err := ConnectWithOptions(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cdb.Close()
+
+	want := Backoff{Min: 10 * time.Millisecond, Max: DefaultBackoff.Max,
+		MaxAttempts: 5}
+	if cdb.LockBackoff != want {
+		t.Fatalf("lock backoff %+v, want %+v", cdb.LockBackoff, want)
+	}
+	want = Backoff{Min: DefaultPollBackoff.Min, Max: time.Second}
+	if cdb.PollBackoff != want {
+		t.Fatalf("poll backoff %+v, want %+v", cdb.PollBackoff, want)
+	}
+
+	// Default Max less than Min is not used
+	if b := (Backoff{Min: time.Minute}).withDefaults(DefaultBackoff); b.Max != b.Min {
+		t.Fatalf("max %v, want min %v", b.Max, b.Min)
+	}
+}
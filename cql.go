@@ -0,0 +1,861 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Cql (Cassandra, AWS Keyspaces, ScyllaDB) backend module
+
+package kscdb
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Tables names
+const (
+	queueTable       = "queue3" // Queue with priority
+	legacyQueueTable = "queue2" // Queue without priority, migrated to queueTable
+	idsTable         = "ids2"   // IDs with 64-bit next_id
+	legacyIDsTable   = "ids"    // IDs with 32-bit next_id, migrated to idsTable
+)
+
+// cqlBackend is gocql storage backend
+type cqlBackend struct {
+	session         *gocql.Session
+	readConsistency gocql.Consistency
+	lockConsistency gocql.Consistency // Lock records read consistency
+	migrated        sync.Map          // Named queues moved from legacy queue table
+}
+
+// newCqlBackend connect to the cql cluster and create tables if not exists
+func newCqlBackend(ctx context.Context, opts Options) (b *cqlBackend, err error) {
+
+	b = new(cqlBackend)
+	b.readConsistency = opts.readConsistency()
+
+	// Lock records are changed with LWT, so they are read with serial
+	// consistency to see committed changes. AWS Keyspaces does not support
+	// serial reads, its LocalQuorum reads are strongly consistent.
+	b.lockConsistency = gocql.Consistency(gocql.LocalSerial)
+	if opts.AWS {
+		b.lockConsistency = gocql.LocalQuorum
+	}
+
+	// Create cluster config
+	cluster, err := opts.cluster(ctx)
+	if err != nil {
+		return
+	}
+	cluster.DisableInitialHostLookup = false
+
+	// Create session
+	if b.session, err = cluster.CreateSession(); err != nil {
+		return
+	}
+
+	// Create tables if not exists
+	// create KEYSPACE IF NOT EXISTS kscdb WITH replication = {
+	// 	'class' : 'SimpleStrategy',
+	// 	'replication_factor' : 3
+	// };
+	var tables = []string{`
+		create TABLE IF NOT EXISTS ` + opts.Keyspace + `.map(
+			key text,
+			data blob,
+			fence bigint,
+			PRIMARY KEY(key)
+		);`, `
+		create TABLE IF NOT EXISTS ` + opts.Keyspace + `.` + legacyIDsTable + `(
+			id_name text,
+			next_id int,
+			PRIMARY KEY(id_name)
+		);`, `
+		create TABLE IF NOT EXISTS ` + opts.Keyspace + `.` + idsTable + `(
+			id_name text,
+			next_id bigint,
+			PRIMARY KEY(id_name)
+		);`, `
+		create TABLE IF NOT EXISTS ` + opts.Keyspace + `.` + queueTable + `(
+			key text, priority int, time timestamp,
+			random text, lock text,
+			data blob, visible timestamp, receives int,
+			fence bigint static,
+			PRIMARY KEY(key, priority, time, random)
+		) WITH CLUSTERING ORDER BY (priority DESC, time ASC, random ASC);`, `
+		create TABLE IF NOT EXISTS ` + opts.Keyspace + `.` + legacyQueueTable + `(
+			key text, time timestamp,
+			random text, lock text,
+			data blob, visible timestamp, receives int,
+			PRIMARY KEY(key, time, random)
+		);`, `
+		create TABLE IF NOT EXISTS ` + opts.Keyspace + `.locks(
+			key text,
+			holder text,
+			owner text,
+			acquired timestamp,
+			expires timestamp,
+			readers map<text, timestamp>,
+			PRIMARY KEY(key)
+		)` + ttlProperties(opts) + `;`, `
+		create TABLE IF NOT EXISTS ` + opts.Keyspace + `.semaphores(
+			key text,
+			holders map<text, timestamp>,
+			PRIMARY KEY(key)
+		);`, `
+		create TABLE IF NOT EXISTS ` + opts.Keyspace + `.fences(
+			key text,
+			issued bigint,
+			PRIMARY KEY(key)
+		);
+		`,
+	}
+	for _, table := range tables {
+		if err = b.execStmt(table); err != nil {
+			b.Close()
+			return
+		}
+	}
+
+	// Enable TTL on AWS Keyspaces tables created by previous versions
+	if opts.AWS {
+		if err = b.enableTTL(opts.Keyspace, "locks"); err != nil {
+			b.Close()
+			return
+		}
+	}
+
+	// Add columns to tables created by previous versions
+	var columns = [][3]string{
+		{"map", "fence", "bigint"},
+		{queueTable, "fence", "bigint static"},
+		{"locks", "readers", "map<text, timestamp>"},
+		{legacyQueueTable, "visible", "timestamp"},
+		{legacyQueueTable, "receives", "int"},
+	}
+	for _, c := range columns {
+		if err = b.addColumn(opts.Keyspace, c[0], c[1], c[2]); err != nil {
+			b.Close()
+			return
+		}
+	}
+
+	return
+}
+
+// ExecStmt executes a statement string.
+func (b *cqlBackend) execStmt(stmt string) error {
+	q := b.session.Query(stmt).RetryPolicy(nil)
+	defer q.Release()
+	return q.Exec()
+}
+
+// addColumn adds column to the table if it does not exists
+func (b *cqlBackend) addColumn(keyspace, table, column, typ string) (err error) {
+	var name string
+	err = b.session.Query(
+		`SELECT column_name FROM system_schema.columns WHERE keyspace_name = ? AND table_name = ? AND column_name = ?`,
+		keyspace, table, column).Scan(&name)
+	if err != ErrNotFound {
+		return
+	}
+	return b.execStmt(`ALTER TABLE ` + keyspace + `.` + table + ` ADD ` +
+		column + ` ` + typ)
+}
+
+// enableTTL enables TTL on AWS Keyspaces table if it is not enabled. AWS
+// Keyspaces rejects writes with TTL to tables without enabled TTL.
+func (b *cqlBackend) enableTTL(keyspace, table string) (err error) {
+	var properties map[string]map[string]string
+	err = b.session.Query(
+		`SELECT custom_properties FROM system_schema_mcs.tables WHERE keyspace_name = ? AND table_name = ?`,
+		keyspace, table).Scan(&properties)
+	if err != nil || properties["ttl"]["status"] == "enabled" {
+		return
+	}
+	return b.execStmt(`ALTER TABLE ` + keyspace + `.` + table + ` WITH ` +
+		awsTTLProperties)
+}
+
+// awsTTLProperties is AWS Keyspaces table properties which enable TTL
+const awsTTLProperties = `CUSTOM_PROPERTIES = {'ttl': {'status': 'enabled'}}`
+
+// ttlProperties returns create table options which enable TTL on AWS
+// Keyspaces, the TTL is enabled by default on other clusters
+func ttlProperties(opts Options) string {
+	if !opts.AWS {
+		return ""
+	}
+	return ` WITH ` + awsTTLProperties
+}
+
+// Close cql session
+func (b *cqlBackend) Close() {
+	b.session.Close()
+}
+
+// Get map value by key
+func (b *cqlBackend) Get(ctx context.Context, key string) (data []byte, err error) {
+	err = b.session.Query(`SELECT data FROM map WHERE key = ? LIMIT 1`,
+		key).WithContext(ctx).Consistency(b.readConsistency).Scan(&data)
+	return
+}
+
+// Set map value by key
+func (b *cqlBackend) Set(ctx context.Context, key string, value []byte) error {
+	return b.session.Query(`UPDATE map SET data = ? WHERE key = ?`,
+		value, key).WithContext(ctx).Exec()
+}
+
+// SetFenced sets map value by key and saves fencing token with it if the
+// token is not older than saved one
+func (b *cqlBackend) SetFenced(ctx context.Context, key string, value []byte, token int64) (ok bool, err error) {
+	return b.updateFenced(ctx, `UPDATE map SET data = ?, fence = ? WHERE key = ?`,
+		token, value, token, key)
+}
+
+// updateFenced executes update stmt with LWT condition which checks that
+// token is not older than fence column. The condition is added to the stmt.
+func (b *cqlBackend) updateFenced(ctx context.Context, stmt string, token int64, values ...interface{}) (ok bool, err error) {
+	for {
+		var fence *int64
+		ok, err = b.session.Query(stmt+` IF fence <= ?`,
+			append(values, token)...).WithContext(ctx).ScanCAS(&fence)
+		if err != nil || ok || fence != nil {
+			return
+		}
+
+		// The record or its fence does not exists, the fence is set if it
+		// was saved by others
+		ok, err = b.session.Query(stmt+` IF fence = null`,
+			values...).WithContext(ctx).ScanCAS(&fence)
+		if err != nil || ok {
+			return
+		}
+	}
+}
+
+// Delete map record by key
+func (b *cqlBackend) Delete(ctx context.Context, key string) error {
+	return b.session.Query(`DELETE FROM map WHERE key = ?`,
+		key).WithContext(ctx).Exec()
+}
+
+// Scan map records with keys from >= key < to
+func (b *cqlBackend) Scan(ctx context.Context, from, to string) (items []KeyValue, err error) {
+	iter := b.session.Query(`
+		SELECT key, data FROM map WHERE key >= ? and key < ?
+		ALLOW FILTERING`,
+		from, to).WithContext(ctx).Iter()
+	for {
+		var item KeyValue
+		if !iter.Scan(&item.Key, &item.Data) {
+			break
+		}
+		items = append(items, item)
+	}
+	err = iter.Close()
+	return
+}
+
+// GetID returns next ID value by key
+func (b *cqlBackend) GetID(ctx context.Context, key string) (nextID int64, err error) {
+	err = b.session.Query(`SELECT next_id FROM `+idsTable+` WHERE id_name = ? LIMIT 1`,
+		key).WithContext(ctx).Consistency(b.readConsistency).Scan(&nextID)
+	if err != ErrNotFound {
+		return
+	}
+	return b.migrateID(ctx, key)
+}
+
+// migrateID copies next ID value by key from legacy ids table with 32-bit
+// next_id column. The value is copied with LWT if it was not copied or set
+// by others.
+func (b *cqlBackend) migrateID(ctx context.Context, key string) (nextID int64, err error) {
+	var legacy int32
+	err = b.session.Query(`SELECT next_id FROM `+legacyIDsTable+` WHERE id_name = ? LIMIT 1`,
+		key).WithContext(ctx).Consistency(b.readConsistency).Scan(&legacy)
+	if err != nil {
+		return
+	}
+	var name string
+	ok, err := b.session.Query(
+		`INSERT INTO `+idsTable+` (id_name, next_id) VALUES (?, ?) IF NOT EXISTS`,
+		key, int64(legacy)).WithContext(ctx).ScanCAS(&name, &nextID)
+	if ok {
+		nextID = int64(legacy)
+	}
+	return
+}
+
+// SetID sets next ID value by key
+func (b *cqlBackend) SetID(ctx context.Context, key string, nextID int64) error {
+	return b.session.Query(`UPDATE `+idsTable+` SET next_id = ? WHERE id_name = ?`,
+		nextID, key).WithContext(ctx).Exec()
+}
+
+// ListIDs returns IDs with keys from >= key < to. IDs of legacy ids table
+// which was not migrated are added to the list.
+func (b *cqlBackend) ListIDs(ctx context.Context, from, to string) (ids []IDInfo, err error) {
+	found := make(map[string]bool)
+	for _, table := range []string{idsTable, legacyIDsTable} {
+		iter := b.session.Query(`
+			SELECT id_name, next_id FROM `+table+` WHERE id_name >= ? and id_name < ?
+			ALLOW FILTERING`,
+			from, to).WithContext(ctx).Iter()
+		for {
+			var id IDInfo
+			if !iter.Scan(&id.Key, &id.NextID) {
+				break
+			}
+			if found[id.Key] {
+				continue
+			}
+			found[id.Key] = true
+			ids = append(ids, id)
+		}
+		if err = iter.Close(); err != nil {
+			return
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Key < ids[j].Key })
+	return
+}
+
+// CompareAndSetID sets next ID value by key to next if it equal to old
+func (b *cqlBackend) CompareAndSetID(ctx context.Context, key string, old, next int64) (ok bool, current int64, err error) {
+	if old == 0 {
+		var name string
+		ok, err = b.session.Query(
+			`INSERT INTO `+idsTable+` (id_name, next_id) VALUES (?, ?) IF NOT EXISTS`,
+			key, next).WithContext(ctx).ScanCAS(&name, &current)
+		if err != nil || ok || current != 0 {
+			return
+		}
+		// The ID exists and equal to 0
+	}
+	ok, err = b.session.Query(
+		`UPDATE `+idsTable+` SET next_id = ? WHERE id_name = ? IF next_id = ?`,
+		next, key, old).WithContext(ctx).ScanCAS(&current)
+	return
+}
+
+// DeleteID removes ID by key from ids and legacy ids tables
+func (b *cqlBackend) DeleteID(ctx context.Context, key string) (err error) {
+	err = b.session.Query(`DELETE FROM `+legacyIDsTable+` WHERE id_name = ?`,
+		key).WithContext(ctx).Exec()
+	if err != nil {
+		return
+	}
+	return b.session.Query(`DELETE FROM `+idsTable+` WHERE id_name = ?`,
+		key).WithContext(ctx).Exec()
+}
+
+// GetLock returns lock record by key, it is read with lock consistency
+func (b *cqlBackend) GetLock(ctx context.Context, key string) (info LockInfo, err error) {
+	info.Key = key
+	err = b.session.Query(
+		`SELECT holder, owner, acquired, expires, readers FROM locks WHERE key = ?`,
+		key).WithContext(ctx).Consistency(b.lockConsistency).Scan(
+		&info.Holder, &info.Owner, &info.Acquired, &info.Expires, &info.Readers)
+	if err != nil {
+		return
+	}
+	info, ok := info.Live(time.Now())
+	if !ok {
+		err = ErrNotFound
+	}
+	return
+}
+
+// AcquireLock sets lock record holder if the lock has not holder
+func (b *cqlBackend) AcquireLock(ctx context.Context, info LockInfo) (ok bool, err error) {
+	var holder string
+	return b.session.Query(
+		`UPDATE locks USING TTL ? SET holder = ?, owner = ?, acquired = ?, expires = ? WHERE key = ? IF holder = null`,
+		lockTTL(info), info.Holder, info.Owner, info.Acquired, info.Expires,
+		info.Key).WithContext(ctx).ScanCAS(&holder)
+}
+
+// RenewLock updates lock record if its holder equal to info holder
+func (b *cqlBackend) RenewLock(ctx context.Context, info LockInfo) (ok bool, err error) {
+	// All columns are updated to set new TTL to them
+	var holder string
+	ok, err = b.session.Query(
+		`UPDATE locks USING TTL ? SET holder = ?, owner = ?, acquired = ?, expires = ? WHERE key = ? IF holder = ?`,
+		lockTTL(info), info.Holder, info.Owner, info.Acquired, info.Expires,
+		info.Key, info.Holder).WithContext(ctx).ScanCAS(&holder)
+	if err == nil && !ok && holder == "" {
+		err = ErrNotFound
+	}
+	return
+}
+
+// ReleaseLock removes lock record holder if it equal to holder, or removes
+// lock record if holder is empty
+func (b *cqlBackend) ReleaseLock(ctx context.Context, key, holder string) (ok bool, err error) {
+	var current string
+	if holder == "" {
+		ok, err = b.session.Query(`DELETE FROM locks WHERE key = ? IF EXISTS`,
+			key).WithContext(ctx).ScanCAS()
+		if err == nil && !ok {
+			err = ErrNotFound
+		}
+		return
+	}
+	ok, err = b.session.Query(
+		`DELETE holder, owner, acquired, expires FROM locks WHERE key = ? IF holder = ?`,
+		key, holder).WithContext(ctx).ScanCAS(&current)
+	if err == nil && !ok && current == "" {
+		err = ErrNotFound
+	}
+	return
+}
+
+// AcquireReader adds reader to the lock record if the lock has not holder
+func (b *cqlBackend) AcquireReader(ctx context.Context, key, reader string, expires time.Time) (ok bool, err error) {
+	var holder string
+	var ttl int
+	if !expires.IsZero() {
+		ttl = ttlSeconds(time.Until(expires))
+	}
+	return b.session.Query(
+		`UPDATE locks USING TTL ? SET readers[?] = ? WHERE key = ? IF holder = null`,
+		ttl, reader, expires, key).WithContext(ctx).ScanCAS(&holder)
+}
+
+// ReleaseReader removes reader from the lock record
+func (b *cqlBackend) ReleaseReader(ctx context.Context, key, reader string) error {
+	return b.session.Query(`DELETE readers[?] FROM locks WHERE key = ?`,
+		reader, key).WithContext(ctx).Exec()
+}
+
+// ListLocks returns lock records with keys from >= key < to
+func (b *cqlBackend) ListLocks(ctx context.Context, from, to string) (locks []LockInfo, err error) {
+	iter := b.session.Query(`
+		SELECT key, holder, owner, acquired, expires, readers FROM locks
+		WHERE key >= ? and key < ?
+		ALLOW FILTERING`,
+		from, to).WithContext(ctx).Iter()
+	now := time.Now()
+	for {
+		var info LockInfo
+		if !iter.Scan(&info.Key, &info.Holder, &info.Owner, &info.Acquired,
+			&info.Expires, &info.Readers) {
+			break
+		}
+		if info, ok := info.Live(now); ok {
+			locks = append(locks, info)
+		}
+	}
+	err = iter.Close()
+	return
+}
+
+// AcquirePermit adds holder to the semaphore permits if number of holders
+// less than capacity
+func (b *cqlBackend) AcquirePermit(ctx context.Context, key, holder string, capacity int, expires time.Time) (ok bool, err error) {
+	return b.updatePermits(ctx, key, func(holders map[string]time.Time) bool {
+		if len(holders) >= capacity {
+			return false
+		}
+		holders[holder] = expires
+		return true
+	})
+}
+
+// RenewPermit updates semaphore holder expiration
+func (b *cqlBackend) RenewPermit(ctx context.Context, key, holder string, expires time.Time) (ok bool, err error) {
+	return b.updatePermits(ctx, key, func(holders map[string]time.Time) bool {
+		if _, ok := holders[holder]; !ok {
+			return false
+		}
+		holders[holder] = expires
+		return true
+	})
+}
+
+// ReleasePermit removes holder from the semaphore permits
+func (b *cqlBackend) ReleasePermit(ctx context.Context, key, holder string) (err error) {
+	_, err = b.updatePermits(ctx, key, func(holders map[string]time.Time) bool {
+		if _, ok := holders[holder]; !ok {
+			return false
+		}
+		delete(holders, holder)
+		return true
+	})
+	return
+}
+
+// updatePermits calls update with not expired semaphore holders and saves
+// them if update returns true. The holders are saved with LWT which checks
+// that they was not changed by others, expired holders are removed.
+func (b *cqlBackend) updatePermits(ctx context.Context, key string, update func(holders map[string]time.Time) bool) (ok bool, err error) {
+
+	// Read current holders
+	var current map[string]time.Time
+	err = b.session.Query(`SELECT holders FROM semaphores WHERE key = ?`,
+		key).WithContext(ctx).Consistency(b.readConsistency).Scan(&current)
+	if err != nil && err != ErrNotFound {
+		return
+	}
+
+	// Save holders, the current is set to saved holders if they was changed
+	for {
+		holders := LivePermits(current, time.Now())
+		if !update(holders) {
+			ok, err = false, nil
+			return
+		}
+		ok, err = b.session.Query(
+			`UPDATE semaphores SET holders = ? WHERE key = ? IF holders = ?`,
+			holders, key, current).WithContext(ctx).ScanCAS(&current)
+		if err != nil || ok {
+			return
+		}
+	}
+}
+
+// NextFence increments and returns fencing token of lock key
+func (b *cqlBackend) NextFence(ctx context.Context, key string) (token int64, err error) {
+
+	// Read current token
+	var issued *int64
+	err = b.session.Query(`SELECT issued FROM fences WHERE key = ?`,
+		key).WithContext(ctx).Consistency(b.readConsistency).Scan(&issued)
+	if err != nil && err != ErrNotFound {
+		return
+	}
+
+	// Increment token, the issued is set to current token if it was changed
+	for {
+		token = 1
+		if issued != nil {
+			token = *issued + 1
+		}
+		var ok bool
+		ok, err = b.session.Query(
+			`UPDATE fences SET issued = ? WHERE key = ? IF issued = ?`,
+			token, key, issued).WithContext(ctx).ScanCAS(&issued)
+		if err != nil || ok {
+			return
+		}
+	}
+}
+
+// Append adds record to named queue
+func (b *cqlBackend) Append(ctx context.Context, key string, rec QueueRecord) error {
+	if err := b.migrateQueue(ctx, key); err != nil {
+		return err
+	}
+	stmt, values := appendQuery(key, rec, nil)
+	return b.session.Query(stmt, values...).WithContext(ctx).Exec()
+}
+
+// AppendBatch adds records to named queue with unlogged batches of
+// queueBatchSize records
+func (b *cqlBackend) AppendBatch(ctx context.Context, key string, recs []QueueRecord) (err error) {
+	if err = b.migrateQueue(ctx, key); err != nil {
+		return
+	}
+	for len(recs) > 0 {
+		n := len(recs)
+		if n > queueBatchSize {
+			n = queueBatchSize
+		}
+		batch := b.session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+		for _, rec := range recs[:n] {
+			batch.Query(appendQuery(key, rec, nil))
+		}
+		if err = b.session.ExecuteBatch(batch); err != nil {
+			return
+		}
+		recs = recs[n:]
+	}
+	return
+}
+
+// AppendFenced adds records to named queue and saves fencing token in the
+// queue static fence column if the token is not older than saved one.
+// Records are added one by one with LWT, so only first records are added if
+// newer token is saved while adding.
+func (b *cqlBackend) AppendFenced(ctx context.Context, key string, recs []QueueRecord, token int64) (ok bool, err error) {
+	if err = b.migrateQueue(ctx, key); err != nil {
+		return
+	}
+	if len(recs) == 0 {
+		return b.updateFenced(ctx,
+			`UPDATE `+queueTable+` SET fence = ? WHERE key = ?`,
+			token, token, key)
+	}
+	for _, rec := range recs {
+		stmt, values := appendQuery(key, rec, &token)
+		if ok, err = b.updateFenced(ctx, stmt, token, values...); err != nil || !ok {
+			return
+		}
+	}
+	return
+}
+
+// appendQuery returns statement and its values which add record to named
+// queue and set fencing token if it is not nil. The record time is set to
+// client current time if it is zero: Available compares records time with
+// client time, so both use the same clock.
+func appendQuery(key string, rec QueueRecord, token *int64) (stmt string, values []interface{}) {
+	stmt = `UPDATE ` + queueTable + ` SET lock = ?, data = ?, receives = ?`
+	values = []interface{}{rec.Lock, rec.Data, rec.Receives}
+	if token != nil {
+		stmt += `, fence = ?`
+		values = append(values, *token)
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	stmt += ` WHERE key = ? AND priority = ? AND time = ? AND random = ?`
+	values = append(values, key, rec.Priority, rec.Time, rec.Random)
+	return
+}
+
+// Available returns up to n first available records of named queue. The
+// records are read by priority levels from highest, records of the level
+// with passed time are read in queue order until n available records found.
+// If maxWait is set the first available record of every level is read to
+// find the oldest one. So the number of read records depends on number of
+// levels and received records, not on the queue length.
+func (b *cqlBackend) Available(ctx context.Context, key string, n int, maxWait time.Duration) (recs []QueueRecord, err error) {
+	if err = b.migrateQueue(ctx, key); err != nil {
+		return
+	}
+	a := NewAvailableRecords(time.Now(), n, maxWait)
+	var priority *int
+	for {
+		if priority, err = b.nextPriority(ctx, key, priority); err != nil {
+			return
+		}
+		if priority == nil {
+			break
+		}
+		var done bool
+		if done, err = b.availableLevel(ctx, key, *priority, a); err != nil {
+			return
+		}
+		if done {
+			break
+		}
+	}
+	if recs = a.Result(); len(recs) == 0 {
+		err = ErrNotFound
+	}
+	return
+}
+
+// nextPriority returns named queue priority level next after priority, or
+// the highest level if priority is nil. Returns nil if there are no more
+// levels.
+func (b *cqlBackend) nextPriority(ctx context.Context, key string, priority *int) (next *int, err error) {
+	stmt := `SELECT priority FROM ` + queueTable + ` WHERE key = ? AND priority < ? LIMIT 1`
+	below := math.MaxInt32
+	if priority == nil {
+		stmt = `SELECT priority FROM ` + queueTable + ` WHERE key = ? AND priority <= ? LIMIT 1`
+	} else {
+		below = *priority
+	}
+	var p int
+	err = b.session.Query(stmt, key, below).WithContext(ctx).
+		Consistency(b.readConsistency).Scan(&p)
+	switch err {
+	case nil:
+		next = &p
+	case ErrNotFound:
+		err = nil
+	}
+	return
+}
+
+// availableLevel adds records of named queue priority level with passed
+// time to a until first available record of the level found and a has n
+// records. Returns true if next levels are not needed.
+func (b *cqlBackend) availableLevel(ctx context.Context, key string, priority int, a *AvailableRecords) (done bool, err error) {
+	pageSize := queuePageSize
+	if a.n > pageSize {
+		pageSize = a.n
+	}
+	iter := b.session.Query(
+		`SELECT `+queueColumns+` FROM `+queueTable+` WHERE key = ? AND priority = ? AND time <= ?`,
+		key, priority, a.now).WithContext(ctx).Consistency(b.readConsistency).
+		PageSize(pageSize).Iter()
+	for !done {
+		var rec QueueRecord
+		if !scanRecord(iter, &rec) {
+			break
+		}
+		if done = a.Add(rec); rec.Available(a.now) && a.Full() {
+			break
+		}
+	}
+	err = iter.Close()
+	return
+}
+
+// Count returns number of named queue records
+func (b *cqlBackend) Count(ctx context.Context, key string, scheduled bool) (n int64, err error) {
+	if err = b.migrateQueue(ctx, key); err != nil {
+		return
+	}
+	// The random is counted to not count the queue static fence row
+	stmt := `SELECT COUNT(random) FROM ` + queueTable + ` WHERE key = ?`
+	values := []interface{}{key}
+	if scheduled {
+		stmt += ` AND time > ? ALLOW FILTERING`
+		values = append(values, time.Now())
+	}
+	err = b.session.Query(stmt, values...).WithContext(ctx).
+		Consistency(b.readConsistency).Scan(&n)
+	return
+}
+
+// Records returns limit records of named queue starting from cursor. The
+// cursor is gocql paging state.
+func (b *cqlBackend) Records(ctx context.Context, key string, cursor []byte, limit int) (recs []QueueRecord, next []byte, err error) {
+	if err = b.migrateQueue(ctx, key); err != nil {
+		return
+	}
+	query := b.session.Query(
+		`SELECT `+queueColumns+` FROM `+queueTable+` WHERE key = ?`,
+		key).WithContext(ctx).Consistency(b.readConsistency)
+	if limit > 0 {
+		query = query.PageSize(limit).PageState(cursor)
+	}
+	iter := query.Iter()
+	if limit > 0 {
+		if next = iter.PageState(); len(next) == 0 {
+			next = nil
+		}
+	}
+	for {
+		var rec QueueRecord
+		if !scanRecord(iter, &rec) {
+			break
+		}
+		if rec.Random == "" {
+			// The queue static fence row without records
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	err = iter.Close()
+	return
+}
+
+// LockRecord sets lock, visibility time and number of receives of named
+// queue record if the record lock equal to rec Lock
+func (b *cqlBackend) LockRecord(ctx context.Context, key string, rec QueueRecord, lock string, visible time.Time, receives int) (ok bool, err error) {
+	var current string
+	return b.session.Query(
+		`UPDATE `+queueTable+` SET lock = ?, visible = ?, receives = ? WHERE key = ? AND priority = ? AND time = ? AND random = ? IF lock = ?`,
+		lock, visible, receives, key, rec.Priority, rec.Time, rec.Random,
+		rec.Lock).WithContext(ctx).ScanCAS(&current)
+}
+
+// Remove removes record from named queue if the record lock equal to rec
+// Lock
+func (b *cqlBackend) Remove(ctx context.Context, key string, rec QueueRecord) (ok bool, err error) {
+	var current string
+	return b.session.Query(
+		`DELETE FROM `+queueTable+` WHERE key = ? AND priority = ? AND time = ? AND random = ? IF lock = ?`,
+		key, rec.Priority, rec.Time, rec.Random, rec.Lock).WithContext(ctx).ScanCAS(&current)
+}
+
+// Clear removes all records from named queue and legacy queue
+func (b *cqlBackend) Clear(ctx context.Context, key string) (err error) {
+	err = b.session.Query(`DELETE FROM `+legacyQueueTable+` WHERE key = ?`,
+		key).WithContext(ctx).Exec()
+	if err != nil {
+		return
+	}
+	return b.session.Query(`DELETE FROM `+queueTable+` WHERE key = ?`,
+		key).WithContext(ctx).Exec()
+}
+
+// migrateQueue moves named queue records from legacy queue table without
+// priority to queue table once per process. Every record is removed from
+// the legacy queue table with LWT first and copied only if it was removed by
+// this process, so records moved and received by others are not copied
+// again. The record is lost if the process stops between removing and
+// copying it. Records added to the legacy queue table by previous versions
+// after the named queue was moved are not moved until the process restarts,
+// so all processes which use the named queue should be upgraded together.
+func (b *cqlBackend) migrateQueue(ctx context.Context, key string) (err error) {
+	if _, ok := b.migrated.Load(key); ok {
+		return
+	}
+
+	iter := b.session.Query(
+		`SELECT time, random, lock, visible, receives, data FROM `+legacyQueueTable+` WHERE key = ?`,
+		key).WithContext(ctx).Iter()
+	var rec QueueRecord
+	for iter.Scan(&rec.Time, &rec.Random, &rec.Lock, &rec.Visible,
+		&rec.Receives, &rec.Data) {
+		var ok bool
+		ok, err = b.session.Query(
+			`DELETE FROM `+legacyQueueTable+` WHERE key = ? AND time = ? AND random = ? IF EXISTS`,
+			key, rec.Time, rec.Random).WithContext(ctx).
+			MapScanCAS(map[string]interface{}{})
+		if err == nil && ok {
+			err = b.session.Query(
+				`INSERT INTO `+queueTable+` (key, priority, time, random, lock, visible, receives, data) VALUES (?, 0, ?, ?, ?, ?, ?, ?)`,
+				key, rec.Time, rec.Random, rec.Lock, rec.Visible, rec.Receives,
+				rec.Data).WithContext(ctx).Exec()
+		}
+		if err != nil {
+			iter.Close()
+			return
+		}
+		rec = QueueRecord{}
+	}
+	if err = iter.Close(); err != nil {
+		return
+	}
+
+	b.migrated.Store(key, true)
+	return
+}
+
+// queuePageSize is minimum number of records read with one request when
+// available records are searched
+const queuePageSize = 100
+
+// queueBatchSize is maximum number of records in AppendBatch batch, AWS
+// Keyspaces supports up to 30 statements in batch
+const queueBatchSize = 30
+
+// queueColumns is queue table columns scanned by scanRecord
+const queueColumns = `priority, time, random, lock, visible, receives, data`
+
+// scanRecord scans queue record selected with queueColumns
+func scanRecord(iter *gocql.Iter, rec *QueueRecord) bool {
+	return iter.Scan(&rec.Priority, &rec.Time, &rec.Random, &rec.Lock,
+		&rec.Visible, &rec.Receives, &rec.Data)
+}
+
+// lockTTL returns cql TTL of lock record
+func lockTTL(info LockInfo) int {
+	if info.Expires.IsZero() {
+		return 0
+	}
+	return ttlSeconds(time.Until(info.Expires))
+}
+
+// ttlSeconds converts ttl to cql TTL in seconds, 0 means no TTL
+func ttlSeconds(ttl time.Duration) int {
+	if ttl <= 0 {
+		return 0
+	}
+	return int((ttl + time.Second - 1) / time.Second)
+}
+
+var _ Backend = (*cqlBackend)(nil)
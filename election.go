@@ -0,0 +1,127 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Leader election module
+
+package kscdb
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// LeaderElection elects single leader between instances which campaign with
+// the same key. The leader holds renewable lease of the key, so when the
+// leader crashes its lease expires after ttl and other instance is elected.
+type LeaderElection struct {
+	cdb *Kscdb
+	key string
+	ttl time.Duration
+
+	// OnElected is called when this instance becomes the leader
+	OnElected func()
+
+	// OnLost is called when this instance lost the leadership because its
+	// lease expired or was unlocked by others. It is not called by Resign.
+	OnLost func()
+
+	mu    sync.Mutex
+	lease *Lease
+}
+
+// LeaderElection creates leader election with key and lease time to live
+func (cdb *Kscdb) LeaderElection(key string, ttl time.Duration) *LeaderElection {
+	return &LeaderElection{cdb: cdb, key: key, ttl: ttl}
+}
+
+// Campaign waits until this instance is elected, kscdb LockBackoff max
+// attempts exceeded or ctx is done. It returns nil at once if this instance
+// is the leader already.
+func (e *LeaderElection) Campaign(ctx context.Context) (err error) {
+	if e.IsLeader() {
+		return
+	}
+
+	lease, err := e.cdb.WithContext(ctx).Lease(e.key, e.ttl)
+	if err != nil {
+		return
+	}
+
+	e.mu.Lock()
+	e.lease = lease
+	e.mu.Unlock()
+	go e.watch(lease)
+
+	if e.OnElected != nil {
+		e.OnElected()
+	}
+	return
+}
+
+// Resign releases the leadership if this instance is the leader
+func (e *LeaderElection) Resign() (err error) {
+	e.mu.Lock()
+	lease := e.lease
+	e.lease = nil
+	e.mu.Unlock()
+
+	if lease == nil {
+		return
+	}
+	return lease.Release()
+}
+
+// IsLeader reports whether this instance is the leader
+func (e *LeaderElection) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lease != nil && e.lease.Err() == nil
+}
+
+// Token returns fencing token of this instance leadership or 0 if this
+// instance is not the leader, see WithFence
+func (e *LeaderElection) Token() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lease == nil {
+		return 0
+	}
+	return e.lease.Token()
+}
+
+// Leader returns current leader owner, see Kscdb.Owner. It returns
+// ErrNotFound if there is no leader.
+func (e *LeaderElection) Leader() (owner string, err error) {
+	info, err := e.cdb.backend.GetLock(e.cdb.Context(), e.key)
+	if err != nil {
+		return
+	}
+	if info.Holder == "" {
+		err = ErrNotFound
+		return
+	}
+	owner = info.Owner
+	return
+}
+
+// watch waits until the lease is lost or released and calls OnLost if it
+// was lost
+func (e *LeaderElection) watch(lease *Lease) {
+	select {
+	case <-lease.Lost():
+	case <-lease.stop:
+		return
+	}
+
+	e.mu.Lock()
+	if e.lease == lease {
+		e.lease = nil
+	}
+	e.mu.Unlock()
+
+	if e.OnLost != nil {
+		e.OnLost()
+	}
+}
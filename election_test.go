@@ -0,0 +1,91 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Leader election tests
+
+package kscdb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLeaderElection(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+	cdb.Owner = "a"
+	other := cdb.WithContext(context.Background())
+	other.Owner = "b"
+
+	const ttl = 60 * time.Millisecond
+	e1 := cdb.LeaderElection("/test/leader", ttl)
+	e2 := other.LeaderElection("/test/leader", ttl)
+	elected, lost := make(chan string, 2), make(chan string, 2)
+	e1.OnElected = func() { elected <- "a" }
+	e1.OnLost = func() { lost <- "a" }
+	e2.OnElected = func() { elected <- "b" }
+	e2.OnLost = func() { lost <- "b" }
+
+	if _, err := e1.Leader(); err != ErrNotFound {
+		t.Fatalf("leader before campaign: %v, want ErrNotFound", err)
+	}
+	if err := e1.Campaign(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !e1.IsLeader() || <-elected != "a" || e1.Token() == 0 {
+		t.Fatal("first instance is not elected")
+	}
+	if owner, err := e2.Leader(); err != nil || owner != "a" {
+		t.Fatalf("leader %s, %v, want a", owner, err)
+	}
+
+	// Second instance waits while the leader renews its lease
+	ctx, cancel := context.WithTimeout(context.Background(), 2*ttl)
+	defer cancel()
+	if err := e2.Campaign(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("campaign: %v, want context.DeadlineExceeded", err)
+	}
+	if e2.IsLeader() || e2.Token() != 0 {
+		t.Fatal("second instance is elected while the leader is alive")
+	}
+
+	// The leader loses its lease and second instance is elected
+	token := e1.Token()
+	cdb.ForceUnlock("/test/leader")
+	select {
+	case who := <-lost:
+		if who != "a" {
+			t.Fatalf("instance %s lost leadership, want a", who)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("leadership loss is not reported")
+	}
+	if e1.IsLeader() {
+		t.Fatal("instance is the leader after loss")
+	}
+	if err := e2.Campaign(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if <-elected != "b" || e2.Token() <= token {
+		t.Fatalf("token %d not greater than previous leader %d", e2.Token(),
+			token)
+	}
+	if owner, _ := e1.Leader(); owner != "b" {
+		t.Fatalf("leader %s, want b", owner)
+	}
+
+	// Resign releases the leadership without OnLost
+	if err := e2.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e1.Leader(); err != ErrNotFound {
+		t.Fatalf("leader after resign: %v, want ErrNotFound", err)
+	}
+	select {
+	case who := <-lost:
+		t.Fatalf("OnLost of instance %s called by Resign", who)
+	case <-time.After(2 * ttl):
+	}
+}
@@ -76,9 +76,6 @@ func main() {
 	}
 	log.Println("Set ID", key, "to", string(value))
 
-	// Reset lock
-	cdb.Unlock(key)
-
 	// Get 10 new IDs parallel
 	var wg sync.WaitGroup
 	for i := 1; i <= 10; i++ {
@@ -18,6 +18,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -34,10 +35,10 @@ const (
 
 // Application parameters type
 type Params struct {
-	// username, passwd string
-	keyspace string
-	host     string
-	aws      bool
+	username, passwd string
+	keyspace         string
+	host             string
+	aws              bool
 }
 
 // Application parameters
@@ -49,8 +50,8 @@ func main() {
 	fmt.Println(appDescr + " ver " + appVersion)
 
 	// Parse application command line parameters
-	// flag.StringVar(&params.username, "username", os.Getenv("KEYSPACES_USERNAME"), "Keyspaces user name")
-	// flag.StringVar(&params.passwd, "passwd", os.Getenv("KEYSPACES_PASSWD"), "Keyspaces user password")
+	flag.StringVar(&params.username, "username", os.Getenv("KEYSPACES_USERNAME"), "Keyspaces user name")
+	flag.StringVar(&params.passwd, "passwd", os.Getenv("KEYSPACES_PASSWD"), "Keyspaces user password")
 	flag.StringVar(&params.keyspace, "keyspace", "kscdb", "keyspace name")
 	flag.StringVar(&params.host, "host", os.Getenv("KEYSPACES_HOST"), "connect to host name")
 	flag.BoolVar(&params.aws, "aws", true, "connect to AWS Keyspaces")
@@ -71,7 +72,21 @@ func main() {
 
 	// Connect to AWS keyspaces
 	log.Println("Start connection to AWS Keyspaces")
-	cdb, err := kscdb.Connect(params.keyspace, params.aws, params.host)
+	opts, err := kscdb.AWSOptions(params.keyspace, params.host)
+	if err != nil {
+		panic(err)
+	}
+	if !params.aws {
+		// Connect to self-hosted Cassandra or ScyllaDB
+		opts = kscdb.Options{Keyspace: params.keyspace, Hosts: []string{params.host}}
+	}
+	if params.username != "" {
+		// Use service specific credentials or Cassandra user
+		opts.Auth = kscdb.AuthPassword
+		opts.Username = params.username
+		opts.Password = params.passwd
+	}
+	cdb, err := kscdb.ConnectWithOptions(context.Background(), opts)
 	if err != nil {
 		panic(err)
 	}
@@ -126,8 +141,8 @@ func main() {
 	// Test lock/unlock
 	log.Println("Lock")
 	lockKey := "/test/lock/001"
-	lockid, err := cdb.Lock(lockKey)
-	fmt.Println("lock:", lockKey, lockid, err)
+	lockid, token, err := cdb.Lock(lockKey)
+	fmt.Println("lock:", lockKey, lockid, token, err)
 
 	log.Println("Unlock")
 	err = cdb.Unlock(lockKey, lockid)
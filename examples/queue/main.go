@@ -4,11 +4,11 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"sync"
 
 	"github.com/kirill-scherba/kscdb"
 )
@@ -68,7 +68,6 @@ func main() {
 
 	key := "/test/queue/002"
 	cdb.Queue.Clear(key)
-	cdb.Unlock(key)
 
 	// Add values to name queue
 	fmt.Println()
@@ -82,23 +81,16 @@ func main() {
 		}
 	}
 
-	// Getvalues from name queue
+	// Get values from name queue by subscription workers
 	fmt.Println()
-	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages := cdb.Queue.Subscribe(ctx, key, 3)
 	for i := 1; i <= num; i++ {
-		wg.Add(1)
-		go func() {
-			data, err := cdb.Queue.Get(key)
-			if err != nil {
-				if err == kscdb.ErrNotFound {
-					// break
-					return
-				}
-				panic("Get value error: " + err.Error())
-			}
-			log.Println("Get value:", string(data))
-			wg.Done()
-		}()
+		msg := <-messages
+		log.Println("Get value:", string(msg.Data))
+		if err := msg.Ack(); err != nil {
+			panic("Ack value error: " + err.Error())
+		}
 	}
-	wg.Wait()
 }
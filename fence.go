@@ -0,0 +1,49 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Fencing tokens module
+
+package kscdb
+
+import "errors"
+
+// ErrStaleToken is returned when write carries fencing token older than the
+// last token seen for its key
+var ErrStaleToken = errors.New("stale fencing token")
+
+// SetOption is Map.Set and Queue.Set option
+type SetOption func(*setOptions)
+
+// setOptions is Map.Set and Queue.Set options
+type setOptions struct {
+	fence bool  // Check fencing token
+	token int64 // Fencing token
+}
+
+// WithFence is Map.Set and Queue.Set option which rejects the write with
+// ErrStaleToken if the token is older than the last token written with the
+// key. The token is checked and saved atomically with the write. The token
+// is fencing token returned by Lock, TryLock, LockTimeout or Lease.Token.
+func WithFence(token int64) SetOption {
+	return func(o *setOptions) {
+		o.fence = true
+		o.token = token
+	}
+}
+
+// newSetOptions applies Set options
+func newSetOptions(opts []SetOption) (o setOptions) {
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return
+}
+
+// fenced returns ErrStaleToken if fenced write was rejected
+func fenced(ok bool, err error) error {
+	if err == nil && !ok {
+		err = ErrStaleToken
+	}
+	return err
+}
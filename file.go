@@ -0,0 +1,185 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Embedded file backend module
+
+package kscdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DefaultCompactEntries is default number of log entries written after
+// last compaction which starts next compaction
+const DefaultCompactEntries = 10000
+
+// Open creates kscdb receiver which uses embedded single node storage backend
+// persisted in local file. It does not need any database cluster.
+func Open(path string) (cdb *Kscdb, err error) {
+	backend, err := newFileBackend(path, DefaultCompactEntries)
+	if err != nil {
+		return
+	}
+	cdb = New(backend)
+	return
+}
+
+// fileBackend is embedded storage backend. It keeps state in memory and
+// persists every state change to the append-only log file. The log file is
+// compacted to the current state snapshot when number of written entries
+// exceeds compactEntries.
+type fileBackend struct {
+	*memBackend
+	path           string
+	file           *os.File
+	writer         *bufio.Writer
+	entries        int // Number of entries written after last compaction
+	compactEntries int // Number of entries which starts compaction
+}
+
+// newFileBackend opens log file, restores state from it and compacts it
+func newFileBackend(path string, compactEntries int) (b *fileBackend, err error) {
+
+	b = &fileBackend{
+		memBackend:     newMemBackend(),
+		path:           path,
+		compactEntries: compactEntries,
+	}
+
+	// Restore state from log file
+	if err = b.restore(); err != nil {
+		return
+	}
+
+	// Compact log file and open it to append
+	if err = b.compact(); err != nil {
+		return
+	}
+	b.journal = b.write
+
+	return
+}
+
+// Close log file
+func (b *fileBackend) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.journal = func(e entry) error { return os.ErrClosed }
+	b.file.Close()
+}
+
+// restore reads log file and applies its entries. The log entries after
+// broken entry (not finished when process crashed) are skipped.
+func (b *fileBackend) restore() (err error) {
+	file, err := os.Open(b.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for {
+		line, errRead := r.ReadBytes('\n')
+		if errRead == io.EOF {
+			// Skip last broken entry
+			return
+		}
+		if errRead != nil {
+			return errRead
+		}
+
+		var e entry
+		if err = json.Unmarshal(line, &e); err != nil {
+			err = fmt.Errorf("can't restore %s: %w", b.path, err)
+			return
+		}
+		b.apply(e)
+	}
+}
+
+// compact writes current state to new log file and replace current log file
+// with it, the b.mu should be locked
+func (b *fileBackend) compact() (err error) {
+
+	// Write current state to temporary file
+	tmp := b.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, e := range b.memBackend.entries() {
+		if err = enc.Encode(e); err != nil {
+			file.Close()
+			return
+		}
+	}
+	if err = w.Flush(); err != nil {
+		file.Close()
+		return
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return
+	}
+	if err = file.Close(); err != nil {
+		return
+	}
+
+	// Replace log file
+	if err = os.Rename(tmp, b.path); err != nil {
+		return
+	}
+	if b.file != nil {
+		b.file.Close()
+	}
+
+	// Open log file to append
+	b.file, err = os.OpenFile(b.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	b.writer = bufio.NewWriter(b.file)
+	b.entries = 0
+
+	return
+}
+
+// write writes entry to the log file and sync it, the b.mu should be locked
+func (b *fileBackend) write(e entry) (err error) {
+
+	// Compact log file
+	if b.compactEntries > 0 && b.entries >= b.compactEntries {
+		if err = b.compact(); err != nil {
+			return
+		}
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	b.writer.Write(data)
+	b.writer.WriteByte('\n')
+	if err = b.writer.Flush(); err != nil {
+		return
+	}
+	if err = b.file.Sync(); err != nil {
+		return
+	}
+	b.entries++
+
+	return
+}
+
+var _ Backend = (*fileBackend)(nil)
@@ -0,0 +1,139 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Embedded file backend tests
+
+package kscdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fillFile writes map value, ID, queue records and lock to cdb
+func fillFile(t *testing.T, cdb *Kscdb) {
+	t.Helper()
+	if err := cdb.Map.Set("/test/key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cdb.ID.NextInt64("/test/id"); err != nil {
+			t.Fatal(err)
+		}
+		if err := cdb.Queue.Set("/test/queue", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := cdb.Lock("/test/lock"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkFile checks state written by fillFile
+func checkFile(t *testing.T, cdb *Kscdb) {
+	t.Helper()
+	if data, err := cdb.Map.Get("/test/key"); err != nil || string(data) != "value" {
+		t.Fatalf("map value %q, %v", data, err)
+	}
+	if nextID, err := cdb.ID.Peek("/test/id"); err != nil || nextID != 4 {
+		t.Fatalf("next ID %d, %v, want 4", nextID, err)
+	}
+	if data, err := cdb.Queue.Get("/test/queue"); err != nil || string(data) != "0" {
+		t.Fatalf("queue value %q, %v, want 0", data, err)
+	}
+	if _, _, err := cdb.TryLock("/test/lock"); err != ErrLocked {
+		t.Fatalf("restored lock: %v, want ErrLocked", err)
+	}
+}
+
+func TestFileRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kscdb.log")
+
+	cdb, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillFile(t, cdb)
+	cdb.Close()
+
+	if cdb, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer cdb.Close()
+	checkFile(t, cdb)
+}
+
+func TestFileCrashRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kscdb.log")
+
+	cdb, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillFile(t, cdb)
+	cdb.Close()
+
+	// Add entry which was not finished when the process crashed
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":1,"key":"/test/broken","da`)
+	f.Close()
+
+	if cdb, err = Open(path); err != nil {
+		t.Fatalf("open log with broken last entry: %v", err)
+	}
+	defer cdb.Close()
+	checkFile(t, cdb)
+	if _, err = cdb.Map.Get("/test/broken"); err != ErrNotFound {
+		t.Fatalf("broken entry applied: %v", err)
+	}
+}
+
+func TestFileCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kscdb.log")
+	if err := os.WriteFile(path, []byte("not json\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Fatal("open corrupted log without error")
+	}
+}
+
+func TestFileCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kscdb.log")
+
+	b, err := newFileBackend(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdb := New(b)
+	for i := 0; i < 100; i++ {
+		if err = cdb.Map.Set("/test/key", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cdb.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The snapshot entry and up to 10 entries written after it
+	if lines := bytes.Count(data, []byte("\n")); lines > 11 {
+		t.Fatalf("%d log entries after compaction, want <= 11", lines)
+	}
+
+	if cdb, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer cdb.Close()
+	if data, _ := cdb.Map.Get("/test/key"); string(data) != "99" {
+		t.Fatalf("value %q after compaction, want 99", data)
+	}
+}
@@ -1,13 +1,15 @@
 package kscdb
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
-
-	"github.com/gocql/gocql"
 )
 
+// ErrIDBackwards is returned by Rewind when it moves next ID backwards
+var ErrIDBackwards = errors.New("can't move next ID backwards")
+
 // IDS define digital ID methods
 type IDs struct {
 	*Kscdb
@@ -15,59 +17,129 @@ type IDs struct {
 
 // SetID set keys next ID value
 func (ids *IDs) Set(key string, value []byte) (err error) {
-	nextID, err := strconv.Atoi(string(value))
+	nextID, err := strconv.ParseInt(string(value), 10, 64)
 	if err != nil {
 		return
 	}
-	// return cdb.session.Query(`UPDATE ids SET next_id = ? WHERE id_name = ?`,
-	// 	nextID, key).Exec()
 	return ids.set(key, nextID)
 }
 
-// GetID returns new diginal ID for key, ID just increments
+// SetInt64 set keys next ID value
+func (ids *IDs) SetInt64(key string, nextID int64) error {
+	return ids.set(key, nextID)
+}
+
+// IDMode define how IDs Get increments next ID value. All clients which
+// get IDs of the same key should use the same mode.
+type IDMode int
+
+// IDs Get modes
+const (
+	// IDLock locks the ID key, reads next ID value and writes it incremented
+	IDLock IDMode = iota
+
+	// IDCAS increments next ID value with compare and set (lightweight
+	// transaction) in one round trip without locks. It works on Cassandra,
+	// ScyllaDB and AWS Keyspaces.
+	IDCAS
+)
+
+// GetID returns new diginal ID for key, ID just increments. The ID is
+// incremented by IDMode of kscdb receiver.
 func (ids *IDs) Get(key string) (data []byte, err error) {
+	id, err := ids.reserve(key, 1)
+	if err != nil {
+		return
+	}
+
+	// Return received nextID in text
+	data = []byte(fmt.Sprintf("%d", id))
+	return
+}
+
+// NextInt64 returns new digital ID for key, ID just increments. The ID is
+// incremented by IDMode of kscdb receiver.
+func (ids *IDs) NextInt64(key string) (id int64, err error) {
+	return ids.reserve(key, 1)
+}
+
+// Reserve atomically advances next ID value of key by n and returns reserved
+// IDs range from first to last inclusive. The next ID is advanced by IDMode
+// of kscdb receiver.
+func (ids *IDs) Reserve(key string, n int64) (first, last int64, err error) {
+	if n <= 0 {
+		err = errors.New("number of reserved IDs should be greater than 0")
+		return
+	}
+	if first, err = ids.reserve(key, n); err != nil {
+		return
+	}
+	last = first + n - 1
+	return
+}
+
+// reserve advances next ID value of key by n and returns first reserved ID
+func (ids *IDs) reserve(key string, n int64) (first int64, err error) {
+	return ids.update(key, func(nextID int64) (int64, error) {
+		return nextID + n, nil
+	})
+}
+
+// update sets next ID value of key to value returned by next, it is called
+// with current next ID value (1 if ID does not exists). Returns the current
+// value. The next ID is updated by IDMode of kscdb receiver.
+func (ids *IDs) update(key string, next func(nextID int64) (int64, error)) (current int64, err error) {
+	switch ids.IDMode {
+	case IDCAS:
+		return ids.updateCAS(key, next)
+	default:
+		return ids.updateLock(key, next)
+	}
+}
+
+// updateCAS updates next ID value with compare and set
+func (ids *IDs) updateCAS(key string, next func(nextID int64) (int64, error)) (current int64, err error) {
 
-	return ids.getAws(key)
-
-	// if 1 != 1 {
-	// 	// var nextID int
-	// 	// Read current counter value with id_name
-	// 	nextID, err := ids.get(key)
-	// 	if err != nil {
-	// 		return
-	// 	}
-
-	// 	// Set new next_id and return current next_id
-	// 	var ok bool
-	// 	// ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
-	// 	// defer cancel()
-	// 	for {
-	// 		// Increment nextID in database
-	// 		if err = ids.session.Query(
-	// 			`UPDATE ids SET next_id = ? WHERE id_name = ? IF next_id = ?`,
-	// 			nextID+1, key, nextID). /* .WithContext(ctx) */ Scan(&ok, &nextID); err != nil {
-	// 			log.Println("Increment current counter error:", err)
-	// 			// continue
-	// 			return
-	// 		}
-	// 		log.Println("Update result:", ok, nextID)
-	// 		if ok {
-	// 			break
-	// 		}
-	// 	}
-
-	// 	// Return received nextID in text
-	// 	data = []byte(fmt.Sprintf("%d", nextID))
-	// }
-	// return
-}
-
-// Get ID for AWS Keyspaces
-func (ids *IDs) getAws(key string) (data []byte, err error) {
+	// Read current next ID, it is 0 if ID does not exists
+	nextID, err := ids.backend.GetID(ids.Context(), key)
+	if err == ErrNotFound {
+		nextID, err = 0, nil
+	}
+	if err != nil {
+		log.Println("Read current counter error:", err)
+		return
+	}
+
+	// Update next ID, the nextID is set to current value if it was changed
+	// by others
+	for {
+		current = nextID
+		if current == 0 {
+			current = 1
+		}
+		var value int64
+		if value, err = next(current); err != nil {
+			return
+		}
+		var ok bool
+		ok, nextID, err = ids.backend.CompareAndSetID(ids.Context(), key,
+			nextID, value)
+		if err != nil {
+			log.Println("Increment current counter error:", err)
+			return
+		}
+		if ok {
+			return
+		}
+	}
+}
+
+// updateLock updates next ID value under the ID key lock
+func (ids *IDs) updateLock(key string, next func(nextID int64) (int64, error)) (current int64, err error) {
 
 	// Lock ID table
 	lockKey := key + "/lock"
-	lockid, err := ids.Lock(lockKey)
+	lockid, err := ids.acquire(lockKey)
 	if err != nil {
 		log.Println("Loc error:", lockKey, err)
 		return
@@ -75,38 +147,33 @@ func (ids *IDs) getAws(key string) (data []byte, err error) {
 	defer ids.Unlock(lockKey, lockid)
 
 	// Read bext ID
-	nextID, err := ids.get(key)
-	if err != nil {
+	if current, err = ids.get(key); err != nil {
 		return
 	}
 
 	// Save new nextID
-	err = ids.set(key, nextID+1)
+	value, err := next(current)
 	if err != nil {
 		return
 	}
-
-	// Return received nextID in text
-	data = []byte(fmt.Sprintf("%d", nextID))
-
+	err = ids.set(key, value)
 	return
 }
 
 // get new diginal ID for key, ID just increments
-func (ids *IDs) get(key string) (nextID int, err error) {
+func (ids *IDs) get(key string) (nextID int64, err error) {
 	// Read current counter value with id_name
-	if err = ids.session.Query(`SELECT next_id FROM ids WHERE id_name = ? LIMIT 1`,
-		key).Consistency(gocql.One).Scan(&nextID); err != nil {
+	if nextID, err = ids.backend.GetID(ids.Context(), key); err != nil {
 
 		// Check error
-		if err != gocql.ErrNotFound {
+		if err != ErrNotFound {
 			log.Println("Read current counter error:", err)
 			return
 		}
 
 		// Create new record if counter with id_name does not exists
 		nextID = 1
-		if err = ids.Set(key, []byte(strconv.Itoa(nextID))); err != nil {
+		if err = ids.set(key, nextID); err != nil {
 			return
 		}
 	}
@@ -115,18 +182,41 @@ func (ids *IDs) get(key string) (nextID int, err error) {
 }
 
 // set keys next ID value
-func (ids *IDs) set(key string, nextID int) (err error) {
-	if err = ids.session.Query(
-		`UPDATE ids SET next_id = ? WHERE id_name = ?`,
-		nextID, key).Exec(); err != nil {
+func (ids *IDs) set(key string, nextID int64) (err error) {
+	if err = ids.backend.SetID(ids.Context(), key, nextID); err != nil {
 		log.Println("Set current counter error:", err)
 		return
 	}
 	return
 }
 
+// Peek returns next ID value of key without incrementing it. It returns
+// ErrNotFound if ID does not exists.
+func (ids *IDs) Peek(key string) (nextID int64, err error) {
+	return ids.backend.GetID(ids.Context(), key)
+}
+
+// List returns all IDs which keys starts from prefix with their next ID
+// values
+func (ids *IDs) List(prefix string) (list []IDInfo, err error) {
+	return ids.backend.ListIDs(ids.Context(), prefix, prefix+maxRune)
+}
+
+// Rewind sets next ID value of key. It returns ErrIDBackwards if nextID less
+// than current next ID value, which may give out duplicate IDs, and force is
+// false. The next ID is set by IDMode of kscdb receiver, so it is safe with
+// concurrent Get.
+func (ids *IDs) Rewind(key string, nextID int64, force bool) (err error) {
+	_, err = ids.update(key, func(current int64) (int64, error) {
+		if nextID < current && !force {
+			return 0, ErrIDBackwards
+		}
+		return nextID, nil
+	})
+	return
+}
+
 // Delete counter from database by key
 func (ids *IDs) Delete(key string) (err error) {
-	return ids.session.Query(`DELETE FROM ids WHERE id_name = ?`,
-		key).Exec()
+	return ids.backend.DeleteID(ids.Context(), key)
 }
@@ -0,0 +1,266 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// IDs tests
+
+package kscdb
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// idModes is IDs Get modes tested
+var idModes = []struct {
+	name string
+	mode IDMode
+}{
+	{"Lock", IDLock},
+	{"CAS", IDCAS},
+}
+
+func TestIDsParallelUnique(t *testing.T) {
+	for _, m := range idModes {
+		t.Run(m.name, func(t *testing.T) {
+			cdb := newTestKscdb()
+			defer cdb.Close()
+			cdb.IDMode = m.mode
+
+			const workers, n = 8, 50
+			var mu sync.Mutex
+			var wg sync.WaitGroup
+			ids := make(map[int64]bool)
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < n; j++ {
+						id, err := cdb.ID.NextInt64("/test/id")
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						mu.Lock()
+						if ids[id] {
+							t.Errorf("duplicate ID %d", id)
+						}
+						ids[id] = true
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+
+			for id := int64(1); id <= workers*n; id++ {
+				if !ids[id] {
+					t.Fatalf("ID %d not issued", id)
+				}
+			}
+		})
+	}
+}
+
+func TestIDsGet(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	if _, err := cdb.ID.Peek("/test/id"); err != ErrNotFound {
+		t.Fatalf("peek not existing ID: %v, want ErrNotFound", err)
+	}
+	data, err := cdb.ID.Get("/test/id")
+	if err != nil || string(data) != "1" {
+		t.Fatalf("first ID %q, %v, want 1", data, err)
+	}
+	if err = cdb.ID.Set("/test/id", []byte("100")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ = cdb.ID.Get("/test/id"); string(data) != "100" {
+		t.Fatalf("ID %q after set, want 100", data)
+	}
+	if nextID, _ := cdb.ID.Peek("/test/id"); nextID != 101 {
+		t.Fatalf("next ID %d, want 101", nextID)
+	}
+}
+
+func TestIDsReserve(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	first, last, err := cdb.ID.Reserve("/test/id", 10)
+	if err != nil || first != 1 || last != 10 {
+		t.Fatalf("reserve %d-%d, %v, want 1-10", first, last, err)
+	}
+	if id, _ := cdb.ID.NextInt64("/test/id"); id != 11 {
+		t.Fatalf("ID %d after reserve, want 11", id)
+	}
+
+	a := cdb.IDAllocator("/test/alloc", 4)
+	for want := int64(1); want <= 10; want++ {
+		if id, err := a.Next(); err != nil || id != want {
+			t.Fatalf("allocator ID %d, %v, want %d", id, err, want)
+		}
+	}
+}
+
+func TestIDsRewind(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	cdb.ID.SetInt64("/test/id", 100)
+	if err := cdb.ID.Rewind("/test/id", 50, false); err != ErrIDBackwards {
+		t.Fatalf("rewind backwards: %v, want ErrIDBackwards", err)
+	}
+	if err := cdb.ID.Rewind("/test/id", 200, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := cdb.ID.Rewind("/test/id", 50, true); err != nil {
+		t.Fatal(err)
+	}
+	if nextID, _ := cdb.ID.Peek("/test/id"); nextID != 50 {
+		t.Fatalf("next ID %d after forced rewind, want 50", nextID)
+	}
+}
+
+func TestIDsList(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	for _, key := range []string{"/test/b", "/test/a", "/other/a"} {
+		cdb.ID.NextInt64(key)
+	}
+	list, err := cdb.ID.List("/test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0] != (IDInfo{"/test/a", 2}) || list[1].Key != "/test/b" {
+		t.Fatalf("list: %+v", list)
+	}
+}
+
+func TestSnowflake(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	s1, err := cdb.Snowflake("/test/sf", DefaultLockTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	s2, err := cdb.Snowflake("/test/sf", DefaultLockTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if s1.Worker() == s2.Worker() {
+		t.Fatalf("generators claimed the same worker %d", s1.Worker())
+	}
+
+	var last int64
+	for i := 0; i < 10000; i++ {
+		id, err := s1.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id <= last {
+			t.Fatalf("ID %d not greater than previous %d", id, last)
+		}
+		last = id
+	}
+	if _, worker, _ := ParseSnowflake(last); worker != s1.Worker() {
+		t.Fatalf("ID worker %d, want %d", worker, s1.Worker())
+	}
+}
+
+func TestSnowflakeTakeover(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	// takeover claims worker number of closed generator s after its holder
+	// saved milliseconds ms
+	takeover := func(s *Snowflake, ms int64) *Snowflake {
+		cdb.Map.Set(s.key, []byte(strconv.FormatInt(ms, 10)))
+		cdb.ID.SetInt64("/test/sf/workers", s.Worker())
+		next, err := cdb.Snowflake("/test/sf", DefaultLockTTL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next.Worker() != s.Worker() {
+			t.Fatalf("claimed worker %d, want %d", next.Worker(), s.Worker())
+		}
+		return next
+	}
+
+	s, err := cdb.Snowflake("/test/sf", DefaultLockTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Previous holder saved milliseconds ahead, IDs are issued after them
+	// without error
+	ms := time.Since(SnowflakeEpoch).Milliseconds() + 100
+	s = takeover(s, ms)
+	id, err := s.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idTime, _, _ := ParseSnowflake(id); idTime.Sub(SnowflakeEpoch).Milliseconds() <= ms {
+		t.Fatalf("ID time %v not after saved milliseconds", idTime)
+	}
+	s.Close()
+
+	// The clock is behind saved milliseconds more than saved ahead
+	s = takeover(s, time.Since(SnowflakeEpoch).Milliseconds()+
+		10*snowflakeSaveAhead)
+	defer s.Close()
+	if _, err = s.Next(); err != ErrClockRegression {
+		t.Fatalf("next: %v, want ErrClockRegression", err)
+	}
+}
+
+func BenchmarkIDsLock(b *testing.B) { benchmarkIDs(b, IDLock) }
+func BenchmarkIDsCAS(b *testing.B)  { benchmarkIDs(b, IDCAS) }
+
+// benchmarkIDs gets IDs in parallel in mode. It uses in-memory backend or
+// database cluster if KSCDB_BENCH_HOST environment variable is set:
+//
+//	KSCDB_BENCH_HOST=cassandra.us-east-1.amazonaws.com go test -bench IDs
+//
+// The KSCDB_BENCH_KEYSPACE sets keyspace name, kscdb by default, and
+// KSCDB_BENCH_AWS=false connects to self-hosted Cassandra.
+func benchmarkIDs(b *testing.B, mode IDMode) {
+	cdb := NewMemory()
+	if host := os.Getenv("KSCDB_BENCH_HOST"); host != "" {
+		keyspace := os.Getenv("KSCDB_BENCH_KEYSPACE")
+		if keyspace == "" {
+			keyspace = "kscdb"
+		}
+		aws, err := strconv.ParseBool(os.Getenv("KSCDB_BENCH_AWS"))
+		if err != nil {
+			aws = true
+		}
+		if cdb, err = Connect(keyspace, aws, host); err != nil {
+			b.Fatal(err)
+		}
+	}
+	defer cdb.Close()
+	cdb.IDMode = mode
+
+	key := "/test/bench/ids"
+	cdb.ID.Delete(key)
+	defer cdb.ID.Delete(key)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := cdb.ID.NextInt64(key); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -11,144 +11,155 @@ package kscdb
 import (
 	"context"
 	"embed"
+	"fmt"
 	"os"
 	"plugin"
-
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sigv4-auth-cassandra-gocql-driver-plugin/sigv4"
-	"github.com/gocql/gocql"
+	"time"
 )
 
 const Version = "0.0.4"
 
 // Kscdb is kscdb packet receiver
 type Kscdb struct {
-	session *gocql.Session
-	aws     bool
+	backend Backend
+	ctx     context.Context
 	ID      IDs
 	Map     Map
 	Queue   Queue
-}
 
-//go:embed crt
-var f embed.FS
+	// LockTTL is time to live of locks created with Lock, the lock never
+	// expires if it is 0. New sets it to DefaultLockTTL.
+	LockTTL time.Duration
 
-const crtFileName = "sf-class2-root.crt"
+	// LockBackoff is lock acquisition backoff. New sets it to
+	// DefaultBackoff.
+	LockBackoff Backoff
 
-// Connect to the cql cluster and return kscdb receiver
-func Connect(keyspace string, aws bool, hosts ...string) (cdb *Kscdb, err error) {
+	// Owner is owner metadata saved in locks, see ListLocks. New sets it to
+	// "hostname:pid".
+	Owner string
 
-	cdb = new(Kscdb)
-	cdb.aws = aws
-	cdb.ID.Kscdb = cdb
-	cdb.Map.Kscdb = cdb
-	cdb.Queue.Kscdb = cdb
+	// IDMode is ID.Get next ID increment mode, IDLock by default
+	IDMode IDMode
 
-	// Add the keyspaces service endpoint
-	cluster := gocql.NewCluster(hosts...)
+	// MaxReceives is maximum number of queue message receives, the message
+	// is moved to dead-letter queue after it. Unlimited if 0.
+	MaxReceives int
 
-	// For AWS Keyspaces
-	if aws {
+	// PollBackoff is empty queue polling backoff used in Queue Wait and
+	// Subscribe. New sets it to DefaultPollBackoff.
+	PollBackoff Backoff
 
-		// Port used when dialing
-		cluster.Port = 9142
+	// VisibilityTimeout is visibility timeout of queue messages received by
+	// Get, GetN and Subscribe: the message which was not removed or acked
+	// appears in the queue again after it, so messages are not lost when
+	// consumer crashes. New sets it to DefaultVisibilityTimeout, it is used
+	// if VisibilityTimeout is 0.
+	VisibilityTimeout time.Duration
 
-		// add your service specific credentials
-		// cluster.Authenticator = gocql.PasswordAuthenticator{
-		// 	Username: username,
-		// 	Password: passwd,
-		// }
+	// QueueMaxWait is queue starvation protection: the oldest queue message
+	// which waits longer than QueueMaxWait is received first regardless of
+	// its priority. Disabled if 0.
+	QueueMaxWait time.Duration
 
-		// Get credentails from AWS Config
-		cfg, errCfg := config.LoadDefaultConfig(context.TODO())
-		if errCfg != nil {
-			err = errCfg
-			return
-		}
-		cre, errCfg := cfg.Credentials.Retrieve(context.TODO())
-		if errCfg != nil {
-			err = errCfg
-			return
-		}
+	lockStats *lockStats
+}
 
-		// Use the SigV4 AWS authentication plugin
-		var auth sigv4.AwsAuthenticator = sigv4.NewAwsAuthenticator()
-		auth.Region = cfg.Region
-		auth.AccessKeyId = cre.AccessKeyID
-		auth.SecretAccessKey = cre.SecretAccessKey
-		cluster.Authenticator = auth
-
-		// Get certificate file from embed fs and write it to tmp folder
-		var data []byte
-		data, err = f.ReadFile("crt/" + crtFileName)
-		if err != nil {
-			return
-		}
-		err = os.WriteFile("/tmp/"+crtFileName, data, 0777)
-		if err != nil {
+//go:embed crt
+var f embed.FS
+
+const crtFileName = "sf-class2-root.crt"
+
+// Connect to the cql cluster and return kscdb receiver. If aws is true it
+// connects to AWS Keyspaces, see AWSOptions.
+func Connect(keyspace string, aws bool, hosts ...string) (cdb *Kscdb, err error) {
+	opts := Options{Keyspace: keyspace, Hosts: hosts}
+	if aws {
+		if opts, err = AWSOptions(keyspace, hosts...); err != nil {
 			return
 		}
+	}
+	return ConnectWithOptions(context.TODO(), opts)
+}
 
-		// Provide the path to the sf-class2-root.crt certificate file
-		cluster.SslOpts = &gocql.SslOptions{
-			CaPath:                 "/tmp/" + crtFileName,
-			EnableHostVerification: false,
+// ConnectWithOptions connect to the cql cluster with options and return
+// kscdb receiver. If options Path is set it opens embedded database instead.
+func ConnectWithOptions(ctx context.Context, opts Options) (cdb *Kscdb, err error) {
+	if opts.Path != "" {
+		cdb, err = Open(opts.Path)
+	} else {
+		var backend *cqlBackend
+		if backend, err = newCqlBackend(ctx, opts); err == nil {
+			cdb = New(backend)
 		}
 	}
-
-	// Override default Consistency to LocalQuorum
-	cluster.Keyspace = keyspace
-	cluster.Consistency = gocql.LocalQuorum
-	cluster.DisableInitialHostLookup = false
-
-	// Create session
-	if cdb.session, err = cluster.CreateSession(); err != nil {
+	if err != nil {
 		return
 	}
-
-	// Create tables if not exists
-	// create KEYSPACE IF NOT EXISTS kscdb WITH replication = {
-	// 	'class' : 'SimpleStrategy',
-	// 	'replication_factor' : 3
-	// };
-	var tables = []string{`
-		create TABLE IF NOT EXISTS ` + keyspace + `.map(
-			key text,
-			data blob,
-			PRIMARY KEY(key)
-		);`, `
-		create TABLE IF NOT EXISTS ` + keyspace + `.ids(
-			id_name text,
-			next_id int,
-			PRIMARY KEY(id_name)
-		);`, `
-		create TABLE IF NOT EXISTS ` + keyspace + `.`+queueTable+`(
-			key text, time timestamp, 
-			random text, lock text, 
-			data blob, 
-			PRIMARY KEY(key, time, random)
-		);
-		`,
+	if opts.LockTTL != 0 {
+		cdb.LockTTL = opts.LockTTL
 	}
-	for _, table := range tables {
-		if err = cdb.execStmt(table); err != nil {
-			return
-		}
+	cdb.LockBackoff = opts.LockBackoff.withDefaults(DefaultBackoff)
+	cdb.PollBackoff = opts.PollBackoff.withDefaults(DefaultPollBackoff)
+	if opts.VisibilityTimeout != 0 {
+		cdb.VisibilityTimeout = opts.VisibilityTimeout
+	}
+	if opts.Owner != "" {
+		cdb.Owner = opts.Owner
 	}
+	cdb.IDMode = opts.IDMode
+	cdb.MaxReceives = opts.MaxReceives
+	cdb.QueueMaxWait = opts.QueueMaxWait
+	return
+}
 
+// New creates kscdb receiver which uses selected storage backend
+func New(backend Backend) (cdb *Kscdb) {
+	cdb = new(Kscdb)
+	cdb.backend = backend
+	cdb.LockTTL = DefaultLockTTL
+	cdb.LockBackoff = DefaultBackoff
+	cdb.PollBackoff = DefaultPollBackoff
+	cdb.VisibilityTimeout = DefaultVisibilityTimeout
+	cdb.lockStats = new(lockStats)
+	cdb.Owner = defaultOwner()
+	cdb.ID.Kscdb = cdb
+	cdb.Map.Kscdb = cdb
+	cdb.Queue.Kscdb = cdb
 	return
 }
 
-// ExecStmt executes a statement string.
-func (cdb *Kscdb) execStmt(stmt string) error {
-	q := cdb.session.Query(stmt).RetryPolicy(nil)
-	defer q.Release()
-	return q.Exec()
+// defaultOwner returns "hostname:pid" owner metadata
+func defaultOwner() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+// WithContext returns copy of kscdb receiver which uses ctx in all its
+// requests. The ctx deadline and cancellation aborts database requests and
+// Lock and Queue retry loops:
+//
+//	data, err := cdb.WithContext(r.Context()).Map.Get(key)
+func (cdb *Kscdb) WithContext(ctx context.Context) *Kscdb {
+	c := *cdb
+	c.ctx = ctx
+	c.ID.Kscdb = &c
+	c.Map.Kscdb = &c
+	c.Queue.Kscdb = &c
+	return &c
+}
+
+// Context returns kscdb receiver context
+func (cdb *Kscdb) Context() context.Context {
+	if cdb.ctx == nil {
+		return context.Background()
+	}
+	return cdb.ctx
 }
 
 // Cloase kscdb connection
 func (cdb *Kscdb) Close() {
-	cdb.session.Close()
+	cdb.backend.Close()
 }
 
 // Func execute plugin function and return data
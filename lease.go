@@ -0,0 +1,215 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Lock lease module
+
+package kscdb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrLeaseLost is returned when the lease expired or was unlocked by others
+var ErrLeaseLost = errors.New("lease lost")
+
+// Lease is lock or semaphore permit with time to live which is renewed by
+// background keep-alive goroutine while the lease is not released or lost.
+type Lease struct {
+	cdb     *Kscdb
+	key     string
+	id      string
+	token   int64
+	ttl     time.Duration
+	renew   func(ctx context.Context, expires time.Time) (bool, error) // Renews lease record
+	release func(ctx context.Context) (bool, error)                    // Removes lease record
+	mu      sync.Mutex
+	expires time.Time     // Local lease expiration time
+	err     error         // Set to ErrLeaseLost when lease is lost
+	lost    chan struct{} // Closed when lease is lost
+	stop    chan struct{} // Closed when lease is released
+}
+
+// Lease acquires lock with time to live ttl and starts keep-alive goroutine
+// which renews it every ttl/3. It waits until the lock is acquired or kscdb
+// receiver context is done.
+func (cdb *Kscdb) Lease(key string, ttl time.Duration) (l *Lease, err error) {
+	if ttl <= 0 {
+		err = errors.New("lease ttl should be greater than 0")
+		return
+	}
+
+	lockid := uuid.New().String()
+	start := time.Now()
+	if err = cdb.lock(key, lockid, ttl); err != nil {
+		return
+	}
+	if err = cdb.waitReaders(key, lockid, ttl); err != nil {
+		return
+	}
+	token, err := cdb.fence(key, lockid, ttl)
+	if err != nil {
+		return
+	}
+
+	l = newLease(cdb, key, lockid, token, ttl, start,
+		func(ctx context.Context, expires time.Time) (bool, error) {
+			info := cdb.lockInfo(key, lockid, ttl)
+			info.Acquired, info.Expires = start, expires
+			return cdb.backend.RenewLock(ctx, info)
+		},
+		func(ctx context.Context) (bool, error) {
+			return cdb.backend.ReleaseLock(ctx, key, lockid)
+		},
+	)
+	return
+}
+
+// newLease creates lease acquired at start and starts its keep-alive
+// goroutine. The renew and release functions renew and remove lease record.
+func newLease(cdb *Kscdb, key, id string, token int64, ttl time.Duration,
+	start time.Time, renew func(ctx context.Context, expires time.Time) (bool, error),
+	release func(ctx context.Context) (bool, error)) (l *Lease) {
+
+	l = &Lease{
+		cdb:     cdb.WithContext(context.Background()),
+		key:     key,
+		id:      id,
+		token:   token,
+		ttl:     ttl,
+		renew:   renew,
+		release: release,
+		expires: start.Add(ttl),
+		lost:    make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	go l.keepAlive()
+	return
+}
+
+// Key returns lease lock key or semaphore name
+func (l *Lease) Key() string { return l.key }
+
+// ID returns lease lock id or semaphore permit
+func (l *Lease) ID() string { return l.id }
+
+// Token returns lease lock fencing token, see WithFence. It is 0 for
+// semaphore permit lease.
+func (l *Lease) Token() int64 { return l.token }
+
+// Lost returns channel which is closed when the lease is lost
+func (l *Lease) Lost() <-chan struct{} { return l.lost }
+
+// Err returns ErrLeaseLost if the lease is lost or nil
+func (l *Lease) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Renew extends the lease to ttl from now. It returns ErrLeaseLost if the
+// lease is lost.
+func (l *Lease) Renew() (err error) {
+	if err = l.Err(); err != nil {
+		return
+	}
+
+	expires := time.Now().Add(l.ttl)
+	ctx, cancel := context.WithTimeout(l.cdb.Context(), l.ttl)
+	defer cancel()
+	ok, err := l.renew(ctx, expires)
+	if err == ErrNotFound || (err == nil && !ok) {
+		err = ErrLeaseLost
+		l.lose()
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	l.expires = expires
+	l.mu.Unlock()
+
+	return
+}
+
+// Release stops keep-alive goroutine and unlocks the lease lock or releases
+// the semaphore permit. It returns ErrLeaseLost if the lease was lost.
+func (l *Lease) Release() (err error) {
+	l.mu.Lock()
+	select {
+	case <-l.stop:
+		// Already released
+		l.mu.Unlock()
+		return
+	default:
+		close(l.stop)
+	}
+	err = l.err
+	l.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	ok, err := l.release(l.cdb.Context())
+	if err == ErrNotFound || (err == nil && !ok) {
+		err = ErrLeaseLost
+	}
+	return
+}
+
+// keepAlive renews the lease every ttl/3 until it released or lost. The
+// lease is lost if it can't be renewed before it expires.
+func (l *Lease) keepAlive() {
+	interval := l.ttl / 3
+	if interval <= 0 {
+		interval = l.ttl
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		switch err := l.Renew(); err {
+		case nil:
+		case ErrLeaseLost:
+			return
+		default:
+			l.mu.Lock()
+			expired := time.Now().After(l.expires)
+			l.mu.Unlock()
+			if expired {
+				l.lose()
+				return
+			}
+		}
+	}
+}
+
+// valid reports whether the lease is not lost and not expired at now
+func (l *Lease) valid(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err == nil && now.Before(l.expires)
+}
+
+// lose marks the lease lost
+func (l *Lease) lose() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err == nil {
+		l.err = ErrLeaseLost
+		close(l.lost)
+	}
+}
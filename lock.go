@@ -1,70 +1,326 @@
 package kscdb
 
 import (
+	"context"
 	"errors"
 	"log"
+	"sync"
+	"time"
 
-	"github.com/gocql/gocql"
 	"github.com/google/uuid"
 )
 
-// Lock access for save concurrence
-func (cdb *Kscdb) Lock(key string) (lockid string, err error) {
+// DefaultLockTTL is default lock time to live
+const DefaultLockTTL = 30 * time.Second
+
+// Lock errors
+var (
+	ErrLocked      = errors.New("the key is locked")
+	ErrMaxAttempts = errors.New("lock max attempts exceeded")
+)
+
+// LockStats is lock acquisition metrics
+type LockStats struct {
+	Acquisitions int64 // Number of acquired locks
+	Failures     int64 // Number of not acquired locks
+	Attempts     int64 // Number of attempts in acquired locks
+	MaxAttempts  int64 // Maximum number of attempts in acquired lock
+}
+
+// lockStats is lock acquisition metrics counter
+type lockStats struct {
+	mu sync.Mutex
+	LockStats
+}
+
+// add adds lock acquisition result to metrics, it does nothing if s is nil
+func (s *lockStats) add(attempts int, acquired bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !acquired {
+		s.Failures++
+		return
+	}
+	s.Acquisitions++
+	s.Attempts += int64(attempts)
+	if int64(attempts) > s.MaxAttempts {
+		s.MaxAttempts = int64(attempts)
+	}
+}
+
+// LockStats returns lock acquisition metrics
+func (cdb *Kscdb) LockStats() LockStats {
+	cdb.lockStats.mu.Lock()
+	defer cdb.lockStats.mu.Unlock()
+	return cdb.lockStats.LockStats
+}
+
+// Lock access for save concurrence. It is exclusive (write) lock, see RLock.
+// It waits until the lock is acquired and all readers unlock the key,
+// LockBackoff max attempts exceeded or kscdb receiver context is done, see
+// WithContext. The waiting writer holds the key so new readers can't lock
+// it. The lock expires after LockTTL if it was not unlocked, use Lease to
+// hold the lock longer.
+//
+// The token is fencing token: it increments every time the key is locked.
+// Send it with writes protected by this lock, see WithFence. It returns
+// ErrLeaseLost if the lock expired before the token was issued.
+func (cdb *Kscdb) Lock(key string) (lockid string, token int64, err error) {
+	return cdb.LockTimeout(cdb.Context(), key)
+}
+
+// LockTimeout access for save concurrence. It waits until the lock is
+// acquired, LockBackoff max attempts exceeded or ctx is done. Attempts are
+// retried with exponential backoff and jitter.
+func (cdb *Kscdb) LockTimeout(ctx context.Context, key string) (lockid string, token int64, err error) {
+	cdb = cdb.WithContext(ctx)
 
 	// Create UUID
 	lockid = uuid.New().String()
 
-	// ctx, cancel := context.WithTimeout(context.Background(), 5000*time.Millisecond)
-	// defer cancel()
-	for {
-		// Seve UUID to keyvalue
-		err = cdb.session.Query(
-			// `UPDATE map SET data = ? WHERE key = ? IF NOT EXIST`,
-			`INSERT INTO map (key, data) VALUES (?,?) IF NOT EXISTS`,
-			key, []byte(lockid)). /* .WithContext(ctx) */ Exec()
+	if err = cdb.lock(key, lockid, cdb.LockTTL); err != nil {
+		return
+	}
+	if err = cdb.waitReaders(key, lockid, cdb.LockTTL); err != nil {
+		return
+	}
+	token, err = cdb.fence(key, lockid, cdb.LockTTL)
+	return
+}
+
+// TryLock makes single attempt to lock access for save concurrence. It
+// returns ErrLocked if the key is locked or read locked by others.
+func (cdb *Kscdb) TryLock(key string) (lockid string, token int64, err error) {
+
+	// Create UUID
+	lockid = uuid.New().String()
+
+	ok, err := cdb.tryLock(key, lockid, cdb.LockTTL)
+	if err == nil && ok {
+		var readers bool
+		if readers, err = cdb.hasReaders(key); err != nil || readers {
+			cdb.Unlock(key, lockid)
+			ok = false
+		}
+	}
+	cdb.lockStats.add(1, ok)
+	if err == nil && !ok {
+		err = ErrLocked
+	}
+	if err != nil {
+		return
+	}
+	token, err = cdb.fence(key, lockid, cdb.LockTTL)
+	return
+}
+
+// acquire waits until the lock is acquired, it does not issue fencing token
+func (cdb *Kscdb) acquire(key string) (lockid string, err error) {
+
+	// Create UUID
+	lockid = uuid.New().String()
+
+	err = cdb.lock(key, lockid, cdb.LockTTL)
+	return
+}
+
+// fence issues fencing token of lock acquired with lockid and ttl. The lock
+// is renewed after the token is issued to check it is still held, so next
+// holders get greater tokens. It returns ErrLeaseLost if the lock expired
+// before, and unlocks the lock if the token was not issued.
+func (cdb *Kscdb) fence(key, lockid string, ttl time.Duration) (token int64, err error) {
+	ctx := cdb.Context()
+	if token, err = cdb.backend.NextFence(ctx, key); err == nil {
+		var ok bool
+		ok, err = cdb.backend.RenewLock(ctx, cdb.lockInfo(key, lockid, ttl))
+		switch {
+		case err == ErrNotFound || (err == nil && !ok):
+			err = ErrLeaseLost
+			return
+		case err == nil:
+			return
+		}
+	}
+	cdb.Unlock(key, lockid)
+	return
+}
+
+// lock waits until the lock with lockid and ttl is acquired
+func (cdb *Kscdb) lock(key, lockid string, ttl time.Duration) error {
+	return cdb.retry("Lock", key, lockid, cdb.lockStats, func() (bool, error) {
+		return cdb.tryLock(key, lockid, ttl)
+	})
+}
+
+// retry calls try with LockBackoff until it returns true, LockBackoff max
+// attempts exceeded or kscdb receiver context is done. The result is added
+// to stats if it is not nil.
+func (cdb *Kscdb) retry(name, key, id string, stats *lockStats, try func() (bool, error)) (err error) {
+
+	ctx := cdb.Context()
+	for attempt := 1; ; attempt++ {
+
+		var ok bool
+		ok, err = try()
+		if ok {
+			stats.add(attempt, true)
+			return
+		}
 		if err != nil {
-			log.Println("Lock INSERT err:", key, lockid, err)
-			// continue
-			// return
+			log.Println(name, "err:", key, id, err)
 		}
 
-		// Check if UUID saved
-		var data []byte
-		data, err = cdb.Map.Get(key)
+		// Check max attempts and wait before next attempt
+		if max := cdb.LockBackoff.MaxAttempts; max > 0 && attempt >= max {
+			err = ErrMaxAttempts
+		} else {
+			err = cdb.LockBackoff.Wait(ctx, attempt)
+		}
 		if err != nil {
-			if err == gocql.ErrNotFound {
-				// log.Println("Lock Get next", key, err)
-				continue
-			}
-			log.Println("Lock Get err:", key, err)
+			stats.add(attempt, false)
+			return
+		}
+	}
+}
+
+// waitReaders waits until all readers release the key locked with lockid.
+// The lock is renewed while waiting and unlocked if waiting failed.
+func (cdb *Kscdb) waitReaders(key, lockid string, ttl time.Duration) (err error) {
+
+	ctx := cdb.Context()
+	for attempt := 1; ; attempt++ {
+
+		var readers bool
+		if readers, err = cdb.hasReaders(key); err == nil && !readers {
 			return
 		}
-		// log.Println("check lock saved", key, string(data), err)
-		if string(data) == lockid {
+		if err != nil {
+			log.Println("Lock readers err:", key, lockid, err)
+		}
+
+		// Wait before next check and renew the lock
+		if err = cdb.LockBackoff.Wait(ctx, attempt); err != nil {
 			break
 		}
+		if ttl > 0 {
+			var ok bool
+			ok, err = cdb.backend.RenewLock(ctx, cdb.lockInfo(key, lockid, ttl))
+			if err == nil && !ok {
+				err = ErrNotFound
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	cdb.Unlock(key, lockid)
+	return
+}
+
+// hasReaders reports whether the key is read locked
+func (cdb *Kscdb) hasReaders(key string) (ok bool, err error) {
+	info, err := cdb.backend.GetLock(cdb.Context(), key)
+	if err == ErrNotFound {
+		err = nil
+		return
+	}
+	ok = len(info.Readers) > 0
+	return
+}
+
+// tryLock makes single attempt to acquire the lock with lockid and ttl
+func (cdb *Kscdb) tryLock(key, lockid string, ttl time.Duration) (ok bool, err error) {
+
+	// Seve lock record
+	ctx := cdb.Context()
+	ok, err = cdb.backend.AcquireLock(ctx, cdb.lockInfo(key, lockid, ttl))
+	if err == nil || ctx.Err() != nil {
+		return
 	}
 
+	// Check if lock record saved when the insert result is unknown
+	info, errGet := cdb.backend.GetLock(ctx, key)
+	if errGet == nil {
+		ok, err = info.Holder == lockid, nil
+	}
+	return
+}
+
+// lockInfo creates lock record acquired now
+func (cdb *Kscdb) lockInfo(key, lockid string, ttl time.Duration) (info LockInfo) {
+	info = LockInfo{
+		Key:      key,
+		Holder:   lockid,
+		Owner:    cdb.Owner,
+		Acquired: time.Now(),
+	}
+	if ttl > 0 {
+		info.Expires = info.Acquired.Add(ttl)
+	}
 	return
 }
 
-// Unlock access for save concurrence
+// Unlock access for save concurrence. It unlocks the key if lockid is not
+// set or equal to the lock holder id.
 func (cdb *Kscdb) Unlock(key string, lockids ...string) (err error) {
 
-	// Get Lock value by key
-	data, err := cdb.Map.Get(key)
+	// Unlock does not use kscdb receiver context to not leave the key locked
+	// when the context is done
+	var lockid string
+	if len(lockids) > 0 {
+		lockid = lockids[0]
+	}
+	ok, err := cdb.backend.ReleaseLock(context.Background(), key, lockid)
 	if err != nil {
 		return
 	}
-
-	// Check lockid if second function parameter is defined
-	if len(lockids) > 0 && string(data) != lockids[0] {
+	if !ok {
 		err = errors.New("can't unlock, the lockid not equal")
-		return
 	}
 
-	// Delete lock key
-	err = cdb.Map.Delete(key)
+	return
+}
 
+// RLock read (shared) lock access for save concurrence. Many readers can
+// lock the key together while it is not locked with Lock. It waits until the
+// lock is acquired, LockBackoff max attempts exceeded or kscdb receiver
+// context is done. The read lock expires after LockTTL if it was not
+// unlocked with RUnlock.
+func (cdb *Kscdb) RLock(key string) (lockid string, err error) {
+
+	// Create UUID
+	lockid = uuid.New().String()
+
+	err = cdb.retry("RLock", key, lockid, cdb.lockStats, func() (bool, error) {
+		var expires time.Time
+		if cdb.LockTTL > 0 {
+			expires = time.Now().Add(cdb.LockTTL)
+		}
+		return cdb.backend.AcquireReader(cdb.Context(), key, lockid, expires)
+	})
 	return
 }
+
+// RUnlock unlocks read lock with lockid
+func (cdb *Kscdb) RUnlock(key, lockid string) error {
+	// Don't use kscdb receiver context, see Unlock
+	return cdb.backend.ReleaseReader(context.Background(), key, lockid)
+}
+
+// ForceUnlock unlocks the key whoever holds or reads it
+func (cdb *Kscdb) ForceUnlock(key string) (err error) {
+	_, err = cdb.backend.ReleaseLock(cdb.Context(), key, "")
+	return
+}
+
+// ListLocks returns all locks which keys starts from prefix
+func (cdb *Kscdb) ListLocks(prefix string) (locks []LockInfo, err error) {
+	return cdb.backend.ListLocks(cdb.Context(), prefix, prefix+maxRune)
+}
+
+// maxRune is maximum unicode code point used as upper bound of keys range
+const maxRune = "\U0010FFFF"
@@ -0,0 +1,294 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Locks tests
+
+package kscdb
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestKscdb creates in-memory kscdb receiver with short lock backoff
+func newTestKscdb() *Kscdb {
+	cdb := NewMemory()
+	cdb.LockBackoff = Backoff{Min: time.Millisecond, Max: 5 * time.Millisecond}
+	return cdb
+}
+
+func TestLockExclusion(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	var holders, overlaps int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				lockid, _, err := cdb.Lock("/test/lock")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if atomic.AddInt32(&holders, 1) > 1 {
+					atomic.AddInt32(&overlaps, 1)
+				}
+				time.Sleep(100 * time.Microsecond)
+				atomic.AddInt32(&holders, -1)
+				if err = cdb.Unlock("/test/lock", lockid); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if overlaps > 0 {
+		t.Fatalf("lock held by %d holders together", overlaps)
+	}
+	if stats := cdb.LockStats(); stats.Acquisitions != 8*20 {
+		t.Fatalf("%d acquisitions, want %d", stats.Acquisitions, 8*20)
+	}
+}
+
+func TestLockFencingToken(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	lockid, token1, err := cdb.Lock("/test/lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdb.Unlock("/test/lock", lockid)
+	_, token2, err := cdb.Lock("/test/lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token2 <= token1 {
+		t.Fatalf("token %d not greater than previous %d", token2, token1)
+	}
+
+	if err = cdb.Map.Set("/test/data", []byte("new"), WithFence(token2)); err != nil {
+		t.Fatal(err)
+	}
+	if err = cdb.Map.Set("/test/data", []byte("old"), WithFence(token1)); err != ErrStaleToken {
+		t.Fatalf("write with stale token: %v, want ErrStaleToken", err)
+	}
+}
+
+// pauseBackend is backend which pauses before issuing fencing token once
+type pauseBackend struct {
+	Backend
+	pause chan chan struct{} // Receives channel closed to resume
+}
+
+// NextFence pauses until resumed if the pause was requested
+func (b *pauseBackend) NextFence(ctx context.Context, key string) (int64, error) {
+	select {
+	case resume := <-b.pause:
+		<-resume
+	default:
+	}
+	return b.Backend.NextFence(ctx, key)
+}
+
+func TestLockFencingTokenPause(t *testing.T) {
+	backend := &pauseBackend{newMemBackend(), make(chan chan struct{}, 1)}
+	cdb := New(backend)
+	defer cdb.Close()
+	cdb.LockBackoff = Backoff{Min: time.Millisecond, Max: 5 * time.Millisecond}
+	cdb.LockTTL = 30 * time.Millisecond
+
+	// First holder pauses between lock and token until its lock expires and
+	// second holder gets the lock and token
+	resume := make(chan struct{})
+	backend.pause <- resume
+	errc := make(chan error)
+	go func() {
+		_, _, err := cdb.Lock("/test/lock")
+		errc <- err
+	}()
+	for len(backend.pause) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_, token, err := cdb.Lock("/test/lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(resume)
+	if err = <-errc; err != ErrLeaseLost {
+		t.Fatalf("paused lock: %v, want ErrLeaseLost", err)
+	}
+
+	if err = cdb.Map.Set("/test/data", []byte("new"), WithFence(token)); err != nil {
+		t.Fatalf("write of current holder: %v", err)
+	}
+}
+
+func TestLockContext(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	if _, _, err := cdb.Lock("/test/lock"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Waiting for locked key stops when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := cdb.WithContext(ctx).Lock("/test/lock"); err != context.DeadlineExceeded {
+		t.Fatalf("lock: %v, want context.DeadlineExceeded", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := cdb.LockTimeout(ctx, "/test/lock"); err != context.Canceled {
+		t.Fatalf("lock timeout: %v, want context.Canceled", err)
+	}
+}
+
+func TestLockUnlockOthers(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	if _, _, err := cdb.Lock("/test/lock"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cdb.Unlock("/test/lock", "other"); err == nil {
+		t.Fatal("unlocked with other lockid")
+	}
+}
+
+func TestLockMaxAttempts(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	if _, _, err := cdb.Lock("/test/lock"); err != nil {
+		t.Fatal(err)
+	}
+	cdb.LockBackoff.MaxAttempts = 3
+	if _, _, err := cdb.Lock("/test/lock"); err != ErrMaxAttempts {
+		t.Fatalf("lock held: %v, want ErrMaxAttempts", err)
+	}
+	if stats := cdb.LockStats(); stats.Failures != 1 {
+		t.Fatalf("%d failures, want 1", stats.Failures)
+	}
+}
+
+func TestRWLock(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	// Many readers
+	reader1, err := cdb.RLock("/test/lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader2, err := cdb.RLock("/test/lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writer can't lock read locked key
+	if _, _, err = cdb.TryLock("/test/lock"); err != ErrLocked {
+		t.Fatalf("try lock with readers: %v, want ErrLocked", err)
+	}
+
+	// Writer waits until readers unlock the key
+	locked := make(chan error, 1)
+	go func() {
+		_, _, err := cdb.Lock("/test/lock")
+		locked <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cdb.RUnlock("/test/lock", reader1)
+	select {
+	case err = <-locked:
+		t.Fatalf("locked with reader: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	cdb.RUnlock("/test/lock", reader2)
+	if err = <-locked; err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers can't lock write locked key
+	cdb.LockBackoff.MaxAttempts = 2
+	if _, err = cdb.RLock("/test/lock"); err != ErrMaxAttempts {
+		t.Fatalf("read lock write locked key: %v, want ErrMaxAttempts", err)
+	}
+}
+
+func TestLease(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	lease, err := cdb.Lease("/test/lease", 60*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lease is renewed longer than ttl
+	time.Sleep(200 * time.Millisecond)
+	if _, _, err = cdb.TryLock("/test/lease"); err != ErrLocked {
+		t.Fatalf("renewed lease: %v, want ErrLocked", err)
+	}
+	if err = lease.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = cdb.TryLock("/test/lease"); err != nil {
+		t.Fatalf("released lease: %v", err)
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	lease, err := cdb.Lease("/test/lease", 60*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdb.ForceUnlock("/test/lease")
+	select {
+	case <-lease.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lease is not lost after force unlock")
+	}
+	if err = lease.Err(); err != ErrLeaseLost {
+		t.Fatalf("lease err: %v, want ErrLeaseLost", err)
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	sem := cdb.Semaphore("/test/sem", 2)
+	permit1, err := sem.TryAcquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sem.TryAcquire(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sem.TryAcquire(); err != ErrNoPermits {
+		t.Fatalf("acquire full semaphore: %v, want ErrNoPermits", err)
+	}
+	if err = sem.Release(permit1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sem.TryAcquire(); err != nil {
+		t.Fatalf("acquire released permit: %v", err)
+	}
+	if stats := cdb.LockStats(); stats != (LockStats{}) {
+		t.Fatalf("semaphore counted in lock stats: %+v", stats)
+	}
+}
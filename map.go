@@ -1,62 +1,46 @@
 package kscdb
 
-import (
-	"github.com/gocql/gocql"
-)
-
 // Map define KeyValue Database methods
 type Map struct {
 	*Kscdb
 }
 
-// Set key value
-func (m *Map) Set(key string, value []byte) (err error) {
-	err = m.session.Query(`UPDATE map SET data = ? WHERE key = ?`,
-		value, key).Exec()
+// Set key value. Use WithFence option to reject writes from stale lock
+// holders.
+func (m *Map) Set(key string, value []byte, opts ...SetOption) (err error) {
+	if o := newSetOptions(opts); o.fence {
+		return fenced(m.backend.SetFenced(m.Context(), key, value, o.token))
+	}
+	err = m.backend.Set(m.Context(), key, value)
 	return
 }
 
 // Get value by key, returns key value or empty data if key not found
 func (m *Map) Get(key string) (data []byte, err error) {
-	// Does not return err of cdb.session.Query function
-	err = m.session.Query(`SELECT data FROM map WHERE key = ? LIMIT 1`,
-		key).Consistency(gocql.One).Scan(&data)
+	data, err = m.backend.Get(m.Context(), key)
 	return
 }
 
 // Delete record from database by key, returns
 func (m *Map) Delete(key string) (err error) {
-	// Does not return err of cdb.session.Query function
-	err = m.session.Query(`DELETE FROM map WHERE key = ?`,
-		key).Exec()
+	err = m.backend.Delete(m.Context(), key)
 	return
 }
 
 // List read and return array of all keys starts from selected key
 func (m *Map) List(key string) (keyList KeyList, err error) {
-	var keyOut string
-	iter := m.session.Query(`
-		SELECT key FROM map WHERE key >= ? and key < ?
-		ALLOW FILTERING`,
-		key, key+"a").Iter()
-	for iter.Scan(&keyOut) {
-		keyList.Append(keyOut)
+	items, err := m.backend.Scan(m.Context(), key, key+"a")
+	for _, item := range items {
+		keyList.Append(item.Key)
 	}
 	return
 }
 
 // ListBody read and return array of all keys data starts from selected key
 func (m *Map) ListBody(key string) (dataList [][]byte, err error) {
-	iter := m.session.Query(`
-		SELECT data FROM map WHERE key >= ? and key < ?
-		ALLOW FILTERING`,
-		key, key+"a").Iter()
-	for {
-		var dataOut []byte
-		if !iter.Scan(&dataOut) {
-			break
-		}
-		dataList = append(dataList, dataOut)
+	items, err := m.backend.Scan(m.Context(), key, key+"a")
+	for _, item := range items {
+		dataList = append(dataList, item.Data)
 	}
 	return
 }
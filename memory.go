@@ -0,0 +1,721 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// In-memory backend module
+
+package kscdb
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NewMemory creates kscdb receiver which uses in-memory storage backend. It
+// may be used in unit tests and local development.
+func NewMemory() *Kscdb {
+	return New(newMemBackend())
+}
+
+// memBackend is in-memory storage backend, it is safe for concurrent use
+type memBackend struct {
+	mu          sync.Mutex
+	maps        map[string][]byte
+	mapFences   map[string]int64 // Fencing tokens saved with map values
+	ids         map[string]int64
+	queue       map[string][]QueueRecord
+	queueFences map[string]int64 // Fencing tokens of named queues
+	fences      map[string]int64 // Last issued fencing tokens of lock keys
+	locks       map[string]LockInfo
+	sems        map[string]map[string]time.Time // Semaphore holders
+	journal     func(e entry) error             // Called before state changes if set
+}
+
+// entry is in-memory backend state change
+type entry struct {
+	Op   entryOp      `json:"op"`
+	Key  string       `json:"key"`
+	Data []byte       `json:"data,omitempty"`
+	ID   int64        `json:"id,omitempty"`
+	Rec  *QueueRecord `json:"rec,omitempty"`
+	Lock *LockInfo    `json:"lock,omitempty"`
+
+	Permits map[string]time.Time `json:"permits,omitempty"`
+}
+
+// entryOp is state change operation
+type entryOp byte
+
+// State change operations
+const (
+	opSet entryOp = iota + 1
+	opDelete
+	opSetID
+	opDeleteID
+	opAppend
+	opRemove
+	opClear
+	opIssueFence
+	opQueueFence
+	opLock
+	opUnlock
+	opPermits
+	opLockRecord
+)
+
+// newMemBackend creates in-memory storage backend
+func newMemBackend() *memBackend {
+	return &memBackend{
+		maps:        make(map[string][]byte),
+		mapFences:   make(map[string]int64),
+		ids:         make(map[string]int64),
+		queue:       make(map[string][]QueueRecord),
+		queueFences: make(map[string]int64),
+		fences:      make(map[string]int64),
+		locks:       make(map[string]LockInfo),
+		sems:        make(map[string]map[string]time.Time),
+	}
+}
+
+// Close in-memory backend
+func (b *memBackend) Close() {}
+
+// commit writes state change to journal and applies it, the b.mu should be
+// locked
+func (b *memBackend) commit(e entry) (err error) {
+	if b.journal != nil {
+		if err = b.journal(e); err != nil {
+			return
+		}
+	}
+	b.apply(e)
+	return
+}
+
+// apply applies state change, the b.mu should be locked
+func (b *memBackend) apply(e entry) {
+	switch e.Op {
+	case opSet:
+		b.maps[e.Key] = clone(e.Data)
+		if e.ID != 0 {
+			b.mapFences[e.Key] = e.ID
+		}
+	case opDelete:
+		delete(b.maps, e.Key)
+		delete(b.mapFences, e.Key)
+	case opSetID:
+		b.ids[e.Key] = e.ID
+	case opDeleteID:
+		delete(b.ids, e.Key)
+	case opAppend:
+		rec := *e.Rec
+		rec.Data = clone(rec.Data)
+		q := b.queue[e.Key]
+		i := sort.Search(len(q), func(i int) bool { return rec.Less(q[i]) })
+		q = append(q, QueueRecord{})
+		copy(q[i+1:], q[i:])
+		q[i] = rec
+		b.queue[e.Key] = q
+		if e.ID != 0 {
+			b.queueFences[e.Key] = e.ID
+		}
+	case opLockRecord:
+		if i, ok := b.find(e.Key, *e.Rec); ok {
+			b.queue[e.Key][i].Lock = e.Rec.Lock
+			b.queue[e.Key][i].Visible = e.Rec.Visible
+			b.queue[e.Key][i].Receives = e.Rec.Receives
+		}
+	case opRemove:
+		q := b.queue[e.Key]
+		if i, ok := b.find(e.Key, *e.Rec); ok {
+			q = append(q[:i], q[i+1:]...)
+		}
+		if len(q) == 0 {
+			delete(b.queue, e.Key)
+			break
+		}
+		b.queue[e.Key] = q
+	case opClear:
+		delete(b.queue, e.Key)
+		delete(b.queueFences, e.Key)
+	case opIssueFence:
+		b.fences[e.Key] = e.ID
+	case opQueueFence:
+		b.queueFences[e.Key] = e.ID
+	case opLock:
+		b.locks[e.Key] = *e.Lock
+	case opUnlock:
+		delete(b.locks, e.Key)
+	case opPermits:
+		if len(e.Permits) == 0 {
+			delete(b.sems, e.Key)
+			break
+		}
+		b.sems[e.Key] = e.Permits
+	}
+}
+
+// entries returns state changes which create current state, the b.mu should
+// be locked
+func (b *memBackend) entries() (entries []entry) {
+	for key, data := range b.maps {
+		entries = append(entries, entry{Op: opSet, Key: key, Data: data,
+			ID: b.mapFences[key]})
+	}
+	for key, nextID := range b.ids {
+		entries = append(entries, entry{Op: opSetID, Key: key, ID: nextID})
+	}
+	for key, token := range b.fences {
+		entries = append(entries, entry{Op: opIssueFence, Key: key, ID: token})
+	}
+	for key, token := range b.queueFences {
+		entries = append(entries, entry{Op: opQueueFence, Key: key, ID: token})
+	}
+	now := time.Now()
+	for key, info := range b.locks {
+		info, ok := info.Live(now)
+		if !ok {
+			continue
+		}
+		entries = append(entries, entry{Op: opLock, Key: key, Lock: &info})
+	}
+	for key, holders := range b.sems {
+		if live := LivePermits(holders, now); len(live) > 0 {
+			entries = append(entries, entry{Op: opPermits, Key: key, Permits: live})
+		}
+	}
+	for key, q := range b.queue {
+		for i := range q {
+			entries = append(entries, entry{Op: opAppend, Key: key, Rec: &q[i]})
+		}
+	}
+	return
+}
+
+// Get map value by key
+func (b *memBackend) Get(ctx context.Context, key string) (data []byte, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	value, ok := b.maps[key]
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	data = clone(value)
+	return
+}
+
+// Set map value by key
+func (b *memBackend) Set(ctx context.Context, key string, value []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.commit(entry{Op: opSet, Key: key, Data: value})
+}
+
+// SetFenced sets map value by key and saves fencing token with it if the
+// token is not older than saved one
+func (b *memBackend) SetFenced(ctx context.Context, key string, value []byte, token int64) (ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if token < b.mapFences[key] {
+		return
+	}
+	if err = b.commit(entry{Op: opSet, Key: key, Data: value, ID: token}); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// Delete map record by key
+func (b *memBackend) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.commit(entry{Op: opDelete, Key: key})
+}
+
+// Scan map records with keys from >= key < to
+func (b *memBackend) Scan(ctx context.Context, from, to string) (items []KeyValue, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key, data := range b.maps {
+		if key >= from && key < to {
+			items = append(items, KeyValue{key, clone(data)})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	return
+}
+
+// GetID returns next ID value by key
+func (b *memBackend) GetID(ctx context.Context, key string) (nextID int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	nextID, ok := b.ids[key]
+	if !ok {
+		err = ErrNotFound
+	}
+	return
+}
+
+// SetID sets next ID value by key
+func (b *memBackend) SetID(ctx context.Context, key string, nextID int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.commit(entry{Op: opSetID, Key: key, ID: nextID})
+}
+
+// ListIDs returns IDs with keys from >= key < to
+func (b *memBackend) ListIDs(ctx context.Context, from, to string) (ids []IDInfo, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key, nextID := range b.ids {
+		if key >= from && key < to {
+			ids = append(ids, IDInfo{key, nextID})
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Key < ids[j].Key })
+	return
+}
+
+// CompareAndSetID sets next ID value by key to next if it equal to old
+func (b *memBackend) CompareAndSetID(ctx context.Context, key string, old, next int64) (ok bool, current int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if current = b.ids[key]; current != old {
+		return
+	}
+	if err = b.commit(entry{Op: opSetID, Key: key, ID: next}); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// DeleteID removes ID by key
+func (b *memBackend) DeleteID(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.commit(entry{Op: opDeleteID, Key: key})
+}
+
+// NextFence increments and returns fencing token of lock key
+func (b *memBackend) NextFence(ctx context.Context, key string) (token int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	token = b.fences[key] + 1
+	err = b.commit(entry{Op: opIssueFence, Key: key, ID: token})
+	return
+}
+
+// GetLock returns lock record by key
+func (b *memBackend) GetLock(ctx context.Context, key string) (info LockInfo, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	info, ok := b.lock(key)
+	if !ok {
+		err = ErrNotFound
+	}
+	return
+}
+
+// AcquireLock sets lock record holder if the lock has not holder
+func (b *memBackend) AcquireLock(ctx context.Context, info LockInfo) (ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current, _ := b.lock(info.Key)
+	if current.Holder != "" {
+		return
+	}
+	info.Readers = current.Readers
+	if err = b.commit(entry{Op: opLock, Key: info.Key, Lock: &info}); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// RenewLock updates lock record if its holder equal to info holder
+func (b *memBackend) RenewLock(ctx context.Context, info LockInfo) (ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current, _ := b.lock(info.Key)
+	if current.Holder == "" {
+		err = ErrNotFound
+		return
+	}
+	if current.Holder != info.Holder {
+		return
+	}
+	info.Readers = current.Readers
+	if err = b.commit(entry{Op: opLock, Key: info.Key, Lock: &info}); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// ReleaseLock removes lock record holder if it equal to holder, or removes
+// lock record if holder is empty
+func (b *memBackend) ReleaseLock(ctx context.Context, key, holder string) (ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current, exists := b.lock(key)
+	if holder == "" {
+		if !exists {
+			err = ErrNotFound
+			return
+		}
+		if err = b.commit(entry{Op: opUnlock, Key: key}); err != nil {
+			return
+		}
+		ok = true
+		return
+	}
+	if current.Holder == "" {
+		err = ErrNotFound
+		return
+	}
+	if current.Holder != holder {
+		return
+	}
+	if err = b.commitLock(LockInfo{Key: key, Readers: current.Readers}); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// AcquireReader adds reader to the lock record if the lock has not holder
+func (b *memBackend) AcquireReader(ctx context.Context, key, reader string, expires time.Time) (ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current, _ := b.lock(key)
+	if current.Holder != "" {
+		return
+	}
+	readers := make(map[string]time.Time, len(current.Readers)+1)
+	for r, e := range current.Readers {
+		readers[r] = e
+	}
+	readers[reader] = expires
+	current.Key, current.Readers = key, readers
+	if err = b.commitLock(current); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// ReleaseReader removes reader from the lock record
+func (b *memBackend) ReleaseReader(ctx context.Context, key, reader string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current, exists := b.lock(key)
+	if _, ok := current.Readers[reader]; !exists || !ok {
+		return nil
+	}
+	readers := make(map[string]time.Time, len(current.Readers))
+	for r, e := range current.Readers {
+		if r != reader {
+			readers[r] = e
+		}
+	}
+	current.Readers = readers
+	return b.commitLock(current)
+}
+
+// ListLocks returns lock records with keys from >= key < to
+func (b *memBackend) ListLocks(ctx context.Context, from, to string) (locks []LockInfo, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for key, info := range b.locks {
+		if key < from || key >= to {
+			continue
+		}
+		if info, ok := info.Live(now); ok {
+			locks = append(locks, info)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Key < locks[j].Key })
+	return
+}
+
+// lock returns lock record without expired holder and readers by key, the
+// b.mu should be locked
+func (b *memBackend) lock(key string) (info LockInfo, ok bool) {
+	info, ok = b.locks[key]
+	if !ok {
+		return
+	}
+	if info, ok = info.Live(time.Now()); !ok {
+		delete(b.locks, key)
+	}
+	return
+}
+
+// commitLock commits lock record or its removing if the record has not
+// holder and readers, the b.mu should be locked
+func (b *memBackend) commitLock(info LockInfo) error {
+	if info.Holder == "" && len(info.Readers) == 0 {
+		return b.commit(entry{Op: opUnlock, Key: info.Key})
+	}
+	return b.commit(entry{Op: opLock, Key: info.Key, Lock: &info})
+}
+
+// AcquirePermit adds holder to the semaphore permits if number of holders
+// less than capacity
+func (b *memBackend) AcquirePermit(ctx context.Context, key, holder string, capacity int, expires time.Time) (ok bool, err error) {
+	return b.updatePermits(key, func(holders map[string]time.Time) bool {
+		if len(holders) >= capacity {
+			return false
+		}
+		holders[holder] = expires
+		return true
+	})
+}
+
+// RenewPermit updates semaphore holder expiration
+func (b *memBackend) RenewPermit(ctx context.Context, key, holder string, expires time.Time) (ok bool, err error) {
+	return b.updatePermits(key, func(holders map[string]time.Time) bool {
+		if _, ok := holders[holder]; !ok {
+			return false
+		}
+		holders[holder] = expires
+		return true
+	})
+}
+
+// ReleasePermit removes holder from the semaphore permits
+func (b *memBackend) ReleasePermit(ctx context.Context, key, holder string) (err error) {
+	_, err = b.updatePermits(key, func(holders map[string]time.Time) bool {
+		if _, ok := holders[holder]; !ok {
+			return false
+		}
+		delete(holders, holder)
+		return true
+	})
+	return
+}
+
+// updatePermits calls update with copy of not expired semaphore holders and
+// commits them if update returns true
+func (b *memBackend) updatePermits(key string, update func(holders map[string]time.Time) bool) (ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	holders := LivePermits(b.sems[key], time.Now())
+	if !update(holders) {
+		return
+	}
+	if err = b.commit(entry{Op: opPermits, Key: key, Permits: holders}); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// Append adds record to named queue
+func (b *memBackend) Append(ctx context.Context, key string, rec QueueRecord) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.append(key, []QueueRecord{rec}, 0)
+}
+
+// AppendBatch adds records to named queue
+func (b *memBackend) AppendBatch(ctx context.Context, key string, recs []QueueRecord) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.append(key, recs, 0)
+}
+
+// AppendFenced adds records to named queue and saves fencing token of the
+// queue if the token is not older than saved one
+func (b *memBackend) AppendFenced(ctx context.Context, key string, recs []QueueRecord, token int64) (ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if token < b.queueFences[key] {
+		return
+	}
+	if err = b.commit(entry{Op: opQueueFence, Key: key, ID: token}); err != nil {
+		return
+	}
+	if err = b.append(key, recs, token); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// append commits records of named queue with fencing token (0 if not
+// fenced), the b.mu should be locked
+func (b *memBackend) append(key string, recs []QueueRecord, token int64) (err error) {
+	now := time.Now()
+	for _, rec := range recs {
+		// Use timestamp (milliseconds) precision as cql does
+		if rec.Time.IsZero() {
+			rec.Time = now
+		}
+		rec.Time = rec.Time.Truncate(time.Millisecond)
+
+		if err = b.commit(entry{Op: opAppend, Key: key, Rec: &rec, ID: token}); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Available returns up to n first available records of named queue
+func (b *memBackend) Available(ctx context.Context, key string, n int, maxWait time.Duration) (recs []QueueRecord, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	a := NewAvailableRecords(time.Now(), n, maxWait)
+	for _, r := range b.queue[key] {
+		if a.Add(r) {
+			break
+		}
+	}
+	if recs = a.Result(); len(recs) == 0 {
+		err = ErrNotFound
+		return
+	}
+	for i := range recs {
+		recs[i].Data = clone(recs[i].Data)
+	}
+	return
+}
+
+// Count returns number of named queue records
+func (b *memBackend) Count(ctx context.Context, key string, scheduled bool) (n int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q := b.queue[key]
+	if !scheduled {
+		n = int64(len(q))
+		return
+	}
+	now := time.Now()
+	for _, r := range q {
+		if r.Time.After(now) {
+			n++
+		}
+	}
+	return
+}
+
+// Records returns limit records of named queue starting from cursor. The
+// cursor is JSON encoded last returned record position.
+func (b *memBackend) Records(ctx context.Context, key string, cursor []byte, limit int) (recs []QueueRecord, next []byte, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q := b.queue[key]
+	var i int
+	if cursor != nil {
+		var after QueueRecord
+		if err = json.Unmarshal(cursor, &after); err != nil {
+			return
+		}
+		i = sort.Search(len(q), func(i int) bool { return after.Less(q[i]) })
+	}
+	for ; i < len(q); i++ {
+		if limit > 0 && len(recs) >= limit {
+			last := recs[len(recs)-1]
+			next, err = json.Marshal(QueueRecord{Priority: last.Priority,
+				Time: last.Time, Random: last.Random})
+			return
+		}
+		r := q[i]
+		r.Data = clone(r.Data)
+		recs = append(recs, r)
+	}
+	return
+}
+
+// LockRecord sets lock, visibility time and number of receives of named
+// queue record if the record lock equal to rec Lock
+func (b *memBackend) LockRecord(ctx context.Context, key string, rec QueueRecord, lock string, visible time.Time, receives int) (ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i, found := b.find(key, rec)
+	if !found || b.queue[key][i].Lock != rec.Lock {
+		return
+	}
+	err = b.commit(entry{Op: opLockRecord, Key: key, Rec: &QueueRecord{
+		Priority: rec.Priority, Time: rec.Time, Random: rec.Random,
+		Lock: lock, Visible: visible, Receives: receives,
+	}})
+	ok = err == nil
+	return
+}
+
+// Remove removes record from named queue if the record lock equal to rec
+// Lock
+func (b *memBackend) Remove(ctx context.Context, key string, rec QueueRecord) (ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i, found := b.find(key, rec)
+	if !found || b.queue[key][i].Lock != rec.Lock {
+		return
+	}
+	err = b.commit(entry{Op: opRemove, Key: key,
+		Rec: &QueueRecord{Priority: rec.Priority, Time: rec.Time,
+			Random: rec.Random}})
+	ok = err == nil
+	return
+}
+
+// find returns index of named queue record, the b.mu should be locked
+func (b *memBackend) find(key string, rec QueueRecord) (i int, ok bool) {
+	q := b.queue[key]
+	i = sort.Search(len(q), func(i int) bool { return !q[i].Less(rec) })
+	ok = i < len(q) && q[i].Time.Equal(rec.Time) && q[i].Random == rec.Random
+	return
+}
+
+// Clear removes all records from named queue
+func (b *memBackend) Clear(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.commit(entry{Op: opClear, Key: key})
+}
+
+// clone returns copy of data
+func clone(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	return append([]byte{}, data...)
+}
+
+var _ Backend = (*memBackend)(nil)
@@ -0,0 +1,129 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// In-memory backend tests
+
+package kscdb
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryMap(t *testing.T) {
+	cdb := NewMemory()
+	defer cdb.Close()
+
+	if _, err := cdb.Map.Get("/test/1"); err != ErrNotFound {
+		t.Fatalf("get not existing key: %v, want ErrNotFound", err)
+	}
+
+	for _, key := range []string{"/test/2", "/test/1", "/other/1"} {
+		if err := cdb.Map.Set(key, []byte("value "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := cdb.Map.Get("/test/1")
+	if err != nil || string(data) != "value /test/1" {
+		t.Fatalf("get: %q, %v", data, err)
+	}
+
+	// The returned data is a copy
+	data[0] = 'X'
+	if data, _ = cdb.Map.Get("/test/1"); string(data) != "value /test/1" {
+		t.Fatalf("stored value changed by caller: %q", data)
+	}
+
+	keys, err := cdb.Map.List("/test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/test/1", "/test/2"}; !reflect.DeepEqual(keys.Keys(), want) {
+		t.Fatalf("list: %v, want %v", keys, want)
+	}
+
+	if err = cdb.Map.Delete("/test/1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cdb.Map.Get("/test/1"); err != ErrNotFound {
+		t.Fatalf("get deleted key: %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryFence(t *testing.T) {
+	cdb := NewMemory()
+	defer cdb.Close()
+
+	if err := cdb.Map.Set("/test/key", []byte("6"), WithFence(6)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cdb.Map.Set("/test/key", []byte("5"), WithFence(5)); err != ErrStaleToken {
+		t.Fatalf("stale map write: %v, want ErrStaleToken", err)
+	}
+	if err := cdb.Map.Set("/test/key", []byte("6+"), WithFence(6)); err != nil {
+		t.Fatalf("write with the same token: %v", err)
+	}
+	if data, _ := cdb.Map.Get("/test/key"); string(data) != "6+" {
+		t.Fatalf("value %q, want 6+", data)
+	}
+
+	if err := cdb.Queue.Set("/test/queue", []byte("2"), WithFence(2)); err != nil {
+		t.Fatal(err)
+	}
+	err := cdb.Queue.SetBatch("/test/queue", [][]byte{[]byte("1")}, WithFence(1))
+	if err != ErrStaleToken {
+		t.Fatalf("stale queue write: %v, want ErrStaleToken", err)
+	}
+	if n, _ := cdb.Queue.Len("/test/queue"); n != 1 {
+		t.Fatalf("queue length %d, want 1", n)
+	}
+}
+
+func TestMemoryLockExpires(t *testing.T) {
+	cdb := NewMemory()
+	defer cdb.Close()
+	cdb.LockTTL = 50 * time.Millisecond
+
+	if _, _, err := cdb.TryLock("/test/lock"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cdb.TryLock("/test/lock"); err != ErrLocked {
+		t.Fatalf("lock held: %v, want ErrLocked", err)
+	}
+	time.Sleep(2 * cdb.LockTTL)
+	if _, _, err := cdb.TryLock("/test/lock"); err != nil {
+		t.Fatalf("lock expired: %v", err)
+	}
+}
+
+func TestMemoryListLocks(t *testing.T) {
+	cdb := NewMemory()
+	defer cdb.Close()
+
+	for i := 1; i <= 3; i++ {
+		if _, _, err := cdb.Lock(fmt.Sprintf("/test/lock/%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := cdb.Lock("/other/lock"); err != nil {
+		t.Fatal(err)
+	}
+
+	locks, err := cdb.ListLocks("/test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locks) != 3 || locks[0].Key != "/test/lock/1" || locks[0].Owner != cdb.Owner {
+		t.Fatalf("list locks: %+v", locks)
+	}
+
+	if err = cdb.ForceUnlock("/test/lock/1"); err != nil {
+		t.Fatal(err)
+	}
+	if locks, _ = cdb.ListLocks("/test/"); len(locks) != 2 {
+		t.Fatalf("%d locks after force unlock, want 2", len(locks))
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Connection options module
+
+package kscdb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sigv4-auth-cassandra-gocql-driver-plugin/sigv4"
+	"github.com/gocql/gocql"
+)
+
+// Auth define cql cluster authentication mode
+type Auth int
+
+// Cql cluster authentication modes
+const (
+	AuthNone     Auth = iota // No authentication
+	AuthPassword             // Username and password authentication
+	AuthSigV4                // AWS SigV4 authentication
+)
+
+// Default connection values
+const (
+	DefaultAWSPort          = 9142
+	DefaultReadConsistency  = gocql.One
+	DefaultWriteConsistency = gocql.LocalQuorum
+)
+
+// Options define cql cluster connection options
+type Options struct {
+	Keyspace string   // Keyspace name
+	Hosts    []string // Cluster hosts
+	Port     int      // Port used when dialing, gocql default (9042) if 0
+
+	Auth     Auth   // Authentication mode
+	Username string // AuthPassword user name
+	Password string // AuthPassword user password
+
+	// AuthSigV4 credentials. If AccessKeyID is empty the credentials and
+	// region are taken from the default AWS config.
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// TLS configuration. The TLS is used if TLS or CA is set. The CA is PEM
+	// encoded root certificates added to the TLS RootCAs, the server
+	// certificate chain is verified with them. Set SkipHostVerification to
+	// not verify server host name, it is used when TLS is nil.
+	TLS                  *tls.Config
+	CA                   []byte
+	SkipHostVerification bool
+
+	Timeout        time.Duration // Query timeout, gocql default if 0
+	ConnectTimeout time.Duration // Connect timeout, gocql default if 0
+
+	// Default read and write consistency, DefaultReadConsistency and
+	// DefaultWriteConsistency if 0
+	ReadConsistency  gocql.Consistency
+	WriteConsistency gocql.Consistency
+
+	// AWS Keyspaces cluster, set by AWSOptions. The TTL is enabled on
+	// tables which use it.
+	AWS bool
+
+	// Local data center name. If set the DC aware round robin token aware
+	// host policy is used
+	LocalDC string
+
+	// Time to live of locks created with Kscdb.Lock, DefaultLockTTL if 0
+	LockTTL time.Duration
+
+	// Lock acquisition backoff, its Min and Max are taken from
+	// DefaultBackoff if they are not set
+	LockBackoff Backoff
+
+	// Empty queue polling backoff, its Min and Max are taken from
+	// DefaultPollBackoff if they are not set
+	PollBackoff Backoff
+
+	// Locks owner metadata, "hostname:pid" if empty
+	Owner string
+
+	// IDs Get next ID increment mode, IDLock if 0
+	IDMode IDMode
+
+	// Maximum number of queue message receives, unlimited if 0
+	MaxReceives int
+
+	// Queue Get and Subscribe visibility timeout, DefaultVisibilityTimeout
+	// if 0
+	VisibilityTimeout time.Duration
+
+	// Queue starvation protection, see Kscdb.QueueMaxWait
+	QueueMaxWait time.Duration
+
+	// Embedded database file path. If set the embedded single node file
+	// backend is used instead of cql cluster, see Open.
+	Path string
+}
+
+// AWSOptions returns Options to connect to AWS Keyspaces: SigV4
+// authentication with credentials from default AWS config, port 9142 and
+// Amazon root certificate. The host name is not verified because cluster
+// peers are dialed by IP address.
+func AWSOptions(keyspace string, hosts ...string) (opts Options, err error) {
+	ca, err := f.ReadFile("crt/" + crtFileName)
+	if err != nil {
+		return
+	}
+	opts = Options{
+		Keyspace: keyspace,
+		Hosts:    hosts,
+		Port:     DefaultAWSPort,
+		Auth:     AuthSigV4,
+		CA:       ca,
+		AWS:      true,
+
+		SkipHostVerification: true,
+	}
+	return
+}
+
+// cluster creates gocql cluster config from options
+func (opts Options) cluster(ctx context.Context) (cluster *gocql.ClusterConfig, err error) {
+
+	if len(opts.Hosts) == 0 {
+		err = errors.New("no hosts to connect")
+		return
+	}
+	cluster = gocql.NewCluster(opts.Hosts...)
+	cluster.Keyspace = opts.Keyspace
+	if opts.Port != 0 {
+		cluster.Port = opts.Port
+	}
+	if opts.Timeout != 0 {
+		cluster.Timeout = opts.Timeout
+	}
+	if opts.ConnectTimeout != 0 {
+		cluster.ConnectTimeout = opts.ConnectTimeout
+	}
+
+	// Set authenticator
+	if cluster.Authenticator, err = opts.authenticator(ctx); err != nil {
+		return
+	}
+
+	// Set TLS
+	if cluster.SslOpts, err = opts.sslOptions(); err != nil {
+		return
+	}
+
+	// Set default consistency to write consistency, the read consistency
+	// is set in select queries
+	cluster.Consistency = opts.WriteConsistency
+	if cluster.Consistency == 0 {
+		cluster.Consistency = DefaultWriteConsistency
+	}
+
+	// Set DC aware host policy
+	if opts.LocalDC != "" {
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(
+			gocql.DCAwareRoundRobinPolicy(opts.LocalDC),
+		)
+	}
+
+	return
+}
+
+// readConsistency returns read consistency
+func (opts Options) readConsistency() gocql.Consistency {
+	if opts.ReadConsistency == 0 {
+		return DefaultReadConsistency
+	}
+	return opts.ReadConsistency
+}
+
+// authenticator creates gocql authenticator depend of Auth mode
+func (opts Options) authenticator(ctx context.Context) (auth gocql.Authenticator, err error) {
+	switch opts.Auth {
+
+	case AuthNone:
+
+	case AuthPassword:
+		auth = gocql.PasswordAuthenticator{
+			Username: opts.Username,
+			Password: opts.Password,
+		}
+
+	case AuthSigV4:
+		a := sigv4.NewAwsAuthenticator()
+		a.Region = opts.Region
+		a.AccessKeyId = opts.AccessKeyID
+		a.SecretAccessKey = opts.SecretAccessKey
+		a.SessionToken = opts.SessionToken
+
+		// Get credentails from AWS Config
+		if a.AccessKeyId == "" {
+			cfg, errCfg := config.LoadDefaultConfig(ctx)
+			if errCfg != nil {
+				err = errCfg
+				return
+			}
+			cre, errCfg := cfg.Credentials.Retrieve(ctx)
+			if errCfg != nil {
+				err = errCfg
+				return
+			}
+			if a.Region == "" {
+				a.Region = cfg.Region
+			}
+			a.AccessKeyId = cre.AccessKeyID
+			a.SecretAccessKey = cre.SecretAccessKey
+			a.SessionToken = cre.SessionToken
+		}
+		auth = a
+
+	default:
+		err = errors.New("wrong authentication mode")
+	}
+	return
+}
+
+// sslOptions creates gocql ssl options from TLS and CA options
+func (opts Options) sslOptions() (sslOpts *gocql.SslOptions, err error) {
+	if opts.TLS == nil && len(opts.CA) == 0 {
+		return
+	}
+
+	tlsConfig := new(tls.Config)
+	if opts.TLS != nil {
+		tlsConfig = opts.TLS.Clone()
+	}
+
+	// Add CA certificates
+	if len(opts.CA) > 0 {
+		if tlsConfig.RootCAs == nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+		}
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(opts.CA) {
+			err = errors.New("can't parse CA certificates")
+			return
+		}
+	}
+
+	// Verify certificate chain only, the tls verifies host name too
+	if opts.TLS == nil && opts.SkipHostVerification {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = verifyChain(tlsConfig.RootCAs)
+	}
+
+	sslOpts = &gocql.SslOptions{
+		Config:                 tlsConfig,
+		EnableHostVerification: !tlsConfig.InsecureSkipVerify,
+	}
+	return
+}
+
+// verifyChain returns tls VerifyConnection function which verifies server
+// certificate chain with roots (system roots if nil) without host name
+func verifyChain(roots *x509.CertPool) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) (err error) {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no server certificates")
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err = cs.PeerCertificates[0].Verify(opts)
+		return
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Connection options tests
+
+package kscdb
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCert creates certificate with name signed by parent, or self-signed
+// CA certificate if parent is nil
+func testCert(t *testing.T, name string, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (cert *x509.Certificate, key *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent,
+		&key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestSSLOptions(t *testing.T) {
+	ca, caKey := testCert(t, "ca", nil, nil)
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+
+	if sslOpts, err := (Options{}).sslOptions(); err != nil || sslOpts != nil {
+		t.Fatalf("ssl options without TLS %v, %v, want nil", sslOpts, err)
+	}
+	if _, err := (Options{CA: []byte("wrong")}).sslOptions(); err == nil {
+		t.Fatal("wrong CA parsed")
+	}
+
+	// Host name is verified by default
+	sslOpts, err := Options{CA: caPEM}.sslOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sslOpts.EnableHostVerification || sslOpts.Config.InsecureSkipVerify ||
+		sslOpts.Config.RootCAs == nil {
+		t.Fatalf("host is not verified with CA: %+v", sslOpts)
+	}
+
+	// Certificate chain is verified when host verification is skipped
+	sslOpts, err = Options{CA: caPEM, SkipHostVerification: true}.sslOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sslOpts.EnableHostVerification || sslOpts.Config.VerifyConnection == nil {
+		t.Fatalf("chain is not verified: %+v", sslOpts)
+	}
+	server, _ := testCert(t, "other.host", ca, caKey)
+	verify := sslOpts.Config.VerifyConnection
+	if err = verify(tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{server}}); err != nil {
+		t.Fatalf("server certificate signed by CA: %v", err)
+	}
+	other, _ := testCert(t, "other.ca", nil, nil)
+	if verify(tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{other}}) == nil {
+		t.Fatal("server certificate not signed by CA verified")
+	}
+	if verify(tls.ConnectionState{}) == nil {
+		t.Fatal("connection without certificates verified")
+	}
+
+	// TLS config is used as is
+	config := &tls.Config{ServerName: "host"}
+	sslOpts, err = Options{TLS: config, SkipHostVerification: true}.sslOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sslOpts.Config.InsecureSkipVerify || sslOpts.Config.ServerName != "host" ||
+		sslOpts.Config == config {
+		t.Fatalf("TLS config changed or not cloned: %+v", sslOpts.Config)
+	}
+}
@@ -1,14 +1,17 @@
 package kscdb
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log"
+	"sync"
 	"time"
 
 	"github.com/gocql/gocql"
 	"github.com/google/uuid"
 )
 
-const queueTable = "queue2"
-
 // Queue define Named Queue Database methods
 type Queue struct {
 	*Kscdb
@@ -16,83 +19,486 @@ type Queue struct {
 
 var ErrNotFound = gocql.ErrNotFound
 
-// Set add value to named queue by key (name of queue)
-func (q *Queue) Set(key string, value []byte) (err error) {
-	uuid := uuid.New().String()
-	return q.session.Query(
-		`UPDATE `+queueTable+` SET lock = '', data = ? WHERE key = ? AND time = toTimestamp(now()) AND random = ?`,
-		value, key, uuid).Exec()
+// DefaultVisibilityTimeout is default visibility timeout of messages received
+// by Get, GetN and Subscribe, see Kscdb VisibilityTimeout
+const DefaultVisibilityTimeout = 30 * time.Second
+
+// ErrReceiptLost is returned by Message methods if the message was removed
+// or received by others after its visibility timeout
+var ErrReceiptLost = errors.New("message receipt lost")
+
+// Set add value to named queue by key (name of queue). Use WithFence option
+// to reject writes from stale lock holders.
+func (q *Queue) Set(key string, value []byte, opts ...SetOption) (err error) {
+	return q.SetAt(key, value, time.Time{}, opts...)
+}
+
+// SetAt add value to named queue by key (name of queue) which is delivered
+// at deliverAt time: Get and Receive return it after this time. The value
+// is delivered at once if deliverAt is zero.
+func (q *Queue) SetAt(key string, value []byte, deliverAt time.Time, opts ...SetOption) (err error) {
+	return q.append(key, value, 0, deliverAt, opts)
+}
+
+// SetPriority add value with priority to named queue by key (name of
+// queue). Get and Receive return values with higher priority first, and
+// values with the same priority in the order they were added. The Set adds
+// values with priority 0. See kscdb QueueMaxWait to protect values with low
+// priority from starvation.
+func (q *Queue) SetPriority(key string, value []byte, priority int, opts ...SetOption) (err error) {
+	return q.append(key, value, priority, time.Time{}, opts)
+}
+
+// append adds value with priority and delivery time to named queue
+func (q *Queue) append(key string, value []byte, priority int, deliverAt time.Time, opts []SetOption) (err error) {
+	// The UUIDv7 tie-breaker orders records added in the same millisecond
+	rec := QueueRecord{
+		Priority: priority, Time: deliverAt, Random: NewUUIDv7().String(),
+		Data: value,
+	}
+	if o := newSetOptions(opts); o.fence {
+		return fenced(q.backend.AppendFenced(q.Context(), key,
+			[]QueueRecord{rec}, o.token))
+	}
+	return q.backend.Append(q.Context(), key, rec)
+}
+
+// SetDelayed add value to named queue by key (name of queue) which is
+// delivered after delay
+func (q *Queue) SetDelayed(key string, value []byte, delay time.Duration, opts ...SetOption) (err error) {
+	return q.SetAt(key, value, time.Now().Add(delay), opts...)
+}
+
+// Scheduled returns number of named queue values which will be delivered
+// in the future, see SetAt
+func (q *Queue) Scheduled(key string) (n int64, err error) {
+	return q.backend.Count(q.Context(), key, true)
 }
 
 // Get get first value from named queue by key (name of queue)
 func (q *Queue) Get(key string) (data []byte, err error) {
+	values, err := q.GetN(key, 1)
+	if err != nil {
+		return
+	}
+	data = values[0]
+	return
+}
 
-	// if q.aws {
-	return q.getAWS(key)
-	//}
+// GetN get up to n first values from named queue by key (name of queue).
+// The values are read with one request and claimed without queue lock. It
+// returns ErrNotFound if the queue is empty. If some values were removed
+// from the queue before an error they are returned without the error, not
+// removed values appear in the queue again after visibility timeout.
+func (q *Queue) GetN(key string, n int) (values [][]byte, err error) {
+	for len(values) == 0 {
+		// Receive first records, they are available again after visibility
+		// timeout if they was not removed
+		var recs []QueueRecord
+		if recs, err = q.receive(key, n, q.visibility(), q.MaxReceives); err != nil {
+			return
+		}
 
-	// Get free value
-	var time time.Time
-	var random string
-	if err = q.session.Query(
-		`SELECT time, random, data FROM `+queueTable+` WHERE key = ? AND lock = '' LIMIT 1 ALLOW FILTERING`,
-		key).Consistency(gocql.One).Scan(&time, &random, &data); err != nil {
-		return
+		// Delete received records from queue and return values
+		for _, rec := range recs {
+			ok, errRemove := q.backend.Remove(q.Context(), key, rec)
+			if errRemove != nil {
+				if len(values) == 0 {
+					err = errRemove
+				}
+				return
+			}
+			if ok {
+				values = append(values, rec.Data)
+			}
+		}
 	}
+	return
+}
+
+// SetBatch add values to named queue by key (name of queue). The values are
+// added with unlogged batches and delivered in the order of values. Use
+// WithFence option to reject writes from stale lock holders, the values are
+// added one by one with the token check then.
+func (q *Queue) SetBatch(key string, values [][]byte, opts ...SetOption) (err error) {
+	// All records get the same time, so they are ordered by the UUIDv7
+	// tie-breaker whichever coordinator writes them
+	now := time.Now()
+	recs := make([]QueueRecord, len(values))
+	for i, value := range values {
+		recs[i] = QueueRecord{Time: now, Random: NewUUIDv7().String(),
+			Data: value}
+	}
+	if o := newSetOptions(opts); o.fence {
+		return fenced(q.backend.AppendFenced(q.Context(), key, recs, o.token))
+	}
+	return q.backend.AppendBatch(q.Context(), key, recs)
+}
 
-	// Loc record (to allow concurency)
-	var ok bool
-	var lock string
-	if err = q.session.Query(
-		`UPDATE `+queueTable+` SET lock = 'locked' WHERE key = ? AND time = ? AND random = ? IF lock = ''`,
-		key, time, random).Consistency(gocql.One).Scan(&ok, &lock); err != nil {
+// Wait get first value from named queue by key (name of queue). It waits
+// until the value is added to empty queue or ctx is done. The queue is
+// polled with kscdb PollBackoff: poll delay grows while the queue is empty.
+func (q *Queue) Wait(ctx context.Context, key string) (data []byte, err error) {
+	c := q.WithContext(ctx)
+	for attempt := 1; ; attempt++ {
+		if data, err = c.Queue.Get(key); err != ErrNotFound {
+			return
+		}
+		if err = c.PollBackoff.Wait(ctx, attempt); err != nil {
+			return
+		}
+	}
+}
+
+// Subscribe receives messages from named queue by key (name of queue) in
+// workers goroutines and delivers them to returned channel until ctx is
+// done. The channel is closed when all workers stopped. The messages are
+// received with VisibilityTimeout, consumers should Ack or Nack them. The
+// worker extends visibility of received message while no consumer is ready
+// to take it, so consumer gets message with at least 3/4 of the timeout
+// left. Empty queue is polled with kscdb PollBackoff.
+func (q *Queue) Subscribe(ctx context.Context, key string, workers int) <-chan Message {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	// Messages are acked and nacked with background context to not leave
+	// them received when ctx is done
+	c := q.WithContext(ctx)
+	acker := &q.WithContext(context.Background()).Queue
+
+	ch := make(chan Message)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for attempt := 1; ; attempt++ {
+				recs, err := c.Queue.receive(key, 1, c.Queue.visibility(),
+					c.MaxReceives)
+				switch {
+				case err == nil:
+					m := Message{q: acker, key: key, rec: recs[0], Data: recs[0].Data}
+					if !m.deliver(ctx, ch, c.Queue.visibility()) {
+						return
+					}
+					attempt = 0
+					continue
+				case err != ErrNotFound && ctx.Err() == nil:
+					log.Println("Queue subscribe err:", key, err)
+				}
+				if c.PollBackoff.Wait(ctx, attempt) != nil {
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	return ch
+}
+
+// deliver sends received message to ch. It extends the message visibility
+// every quarter of visibility timeout until the message is taken. Returns
+// false if ctx is done, the message is nacked then. The message which
+// receipt was lost is dropped.
+func (m *Message) deliver(ctx context.Context, ch chan<- Message, visibility time.Duration) bool {
+	ticker := time.NewTicker(visibility / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case ch <- *m:
+			return true
+		case <-ctx.Done():
+			m.Nack()
+			return false
+		case <-ticker.C:
+			if err := m.ExtendVisibility(visibility); err != nil {
+				if err != ErrReceiptLost {
+					log.Println("Queue subscribe err:", m.key, err)
+				}
+				return true
+			}
+		}
+	}
+}
+
+// Receive receives first value from named queue by key (name of queue). The
+// received message is hidden from others during visibility timeout, it
+// should be removed with Ack or returned with Nack. Not acked message
+// appears in the queue again after the timeout. If kscdb MaxReceives is set
+// message received MaxReceives times is moved to dead-letter queue, see
+// DeadLetterKey, instead of next receive.
+func (q *Queue) Receive(key string, visibility time.Duration) (m *Message, err error) {
+	if visibility <= 0 {
+		err = errors.New("visibility timeout should be greater than 0")
 		return
 	}
-	if !ok {
-		return q.Get(key)
+	recs, err := q.receive(key, 1, visibility, q.MaxReceives)
+	if err != nil {
+		return
+	}
+	m = &Message{q: q, key: key, rec: recs[0], Data: recs[0].Data}
+	return
+}
+
+// receive locks up to n first available records of named queue with new
+// receipt id for visibility timeout, it should be greater than 0. Records
+// received maxReceives times are moved to dead-letter queue, unless
+// maxReceives is 0.
+func (q *Queue) receive(key string, n int, visibility time.Duration, maxReceives int) (recs []QueueRecord, err error) {
+	if n <= 0 {
+		err = errors.New("number of records should be greater than 0")
+		return
 	}
+	receipt := uuid.New().String()
+	ctx := q.Context()
+	for len(recs) == 0 {
+		var available []QueueRecord
+		if available, err = q.backend.Available(ctx, key, n, q.QueueMaxWait); err != nil {
+			return
+		}
+		for _, rec := range available {
+			if maxReceives > 0 && rec.Receives >= maxReceives {
+				if err = q.deadLetter(key, rec, receipt); err != nil {
+					return
+				}
+				continue
+			}
+			visible := time.Now().Add(visibility)
+			var ok bool
+			ok, err = q.backend.LockRecord(ctx, key, rec, receipt, visible,
+				rec.Receives+1)
+			if err != nil {
+				return
+			}
+			if ok {
+				rec.Lock, rec.Visible, rec.Receives = receipt, visible, rec.Receives+1
+				recs = append(recs, rec)
+			}
+		}
 
-	// Delete locket record from queue and return value
-	err = q.session.Query(
-		`DELETE FROM `+queueTable+` WHERE key = ? AND time = ? AND random = ?`,
-		key, time, random).Exec()
+		// All records was received by others, get next ones
+		if err = ctx.Err(); err != nil {
+			return
+		}
+	}
 	return
 }
 
-// getAWS get first value from named queue by key (name of queue)
-func (q *Queue) getAWS(key string) (data []byte, err error) {
+// visibility returns visibility timeout of messages received by Get, GetN
+// and Subscribe
+func (q *Queue) visibility() time.Duration {
+	if q.VisibilityTimeout <= 0 {
+		return DefaultVisibilityTimeout
+	}
+	return q.VisibilityTimeout
+}
+
+// deadLetter moves record of named queue to its dead-letter queue
+func (q *Queue) deadLetter(key string, rec QueueRecord, receipt string) (err error) {
+	ctx := q.Context()
 
-	// Lock by key
-	lockid, err := q.Lock(key)
-	if err != nil {
+	// Lock record, it is available again after visibility timeout if it was
+	// not moved
+	visible := time.Now().Add(q.visibility())
+	ok, err := q.backend.LockRecord(ctx, key, rec, receipt, visible,
+		rec.Receives)
+	if err != nil || !ok {
 		return
 	}
-	defer q.Unlock(key, lockid)
+	rec.Lock = receipt
 
-	// Get first value
-	// log.Println("Get")
-	var saveTime time.Time
-	var random string
-	if err = q.session.Query(
-		`SELECT time, random, data FROM `+queueTable+` WHERE key = ? AND lock = '' LIMIT 1 ALLOW FILTERING`,
-		key).Consistency(gocql.One).Scan(&saveTime, &random, &data); err != nil {
+	// Move record with its id, time and number of receives
+	err = q.backend.Append(ctx, DeadLetterKey(key), QueueRecord{
+		Priority: rec.Priority, Time: rec.Time, Random: rec.Random,
+		Data: rec.Data, Receives: rec.Receives,
+	})
+	if err != nil {
 		return
 	}
+	_, err = q.backend.Remove(ctx, key, rec)
+	return
+}
+
+// DeadLetterKey returns dead-letter queue key of named queue
+func DeadLetterKey(key string) string {
+	return key + "/dlq"
+}
+
+// DeadLetters returns first limit messages of named queue dead-letter queue,
+// or all messages if limit is 0. The messages keep their id, time added to
+// the named queue and number of receives.
+func (q *Queue) DeadLetters(key string, limit int) (items []QueueItem, err error) {
+	recs, _, err := q.backend.Records(q.Context(), DeadLetterKey(key), nil,
+		limit)
+	for _, rec := range recs {
+		items = append(items, queueItem(rec))
+	}
+	return
+}
+
+// Redrive moves all records of named queue dead-letter queue back to the
+// end of the named queue with reset number of receives. Returns number of
+// moved records.
+func (q *Queue) Redrive(key string) (n int, err error) {
+	ctx := q.Context()
+	dlq := DeadLetterKey(key)
+	for {
+		var recs []QueueRecord
+		if recs, err = q.receive(dlq, 1, q.visibility(), 0); err != nil {
+			if err == ErrNotFound {
+				err = nil
+			}
+			return
+		}
+		rec := recs[0]
+		err = q.backend.Append(ctx, key, QueueRecord{
+			Priority: rec.Priority, Random: NewUUIDv7().String(),
+			Data: rec.Data,
+		})
+		if err != nil {
+			return
+		}
+		if _, err = q.backend.Remove(ctx, dlq, rec); err != nil {
+			return
+		}
+		n++
+	}
+}
+
+// QueueItem is named queue message information returned by Peek and Browse
+type QueueItem struct {
+	ID       string    // Message id
+	Priority int       // Message priority, see SetPriority
+	Time     time.Time // Time added or scheduled delivery time
+	Locked   bool      // Message is received and not acked
+	Visible  time.Time // Time the locked message appears in queue again
+	Receives int       // Number of receives
+	Data     []byte    // Message data
+}
 
-	// log.Println("Get", time, random, string(data))
+// queueItem creates queue message information from queue record
+func queueItem(rec QueueRecord) QueueItem {
+	return QueueItem{
+		ID:       rec.Random,
+		Priority: rec.Priority,
+		Time:     rec.Time,
+		Locked:   !rec.Available(time.Now()),
+		Visible:  rec.Visible,
+		Receives: rec.Receives,
+		Data:     rec.Data,
+	}
+}
 
-	// Delete locket record from queue and return value
-	err = q.session.Query(
-		`DELETE FROM `+queueTable+` WHERE key = ? AND time = ? AND random = ?`,
-		key, saveTime, random).Exec()
+// Len returns number of messages in named queue by key (name of queue),
+// including received and scheduled messages
+func (q *Queue) Len(key string) (n int64, err error) {
+	return q.backend.Count(q.Context(), key, false)
+}
 
-	// time.Sleep(30*time.Millisecond)
+// Peek returns first message of named queue by key (name of queue) which
+// Get returns next, without receiving it. It returns ErrNotFound if there
+// is no available messages.
+func (q *Queue) Peek(key string) (item QueueItem, err error) {
+	recs, err := q.backend.Available(q.Context(), key, 1, q.QueueMaxWait)
+	if err != nil {
+		return
+	}
+	item = queueItem(recs[0])
+	return
+}
 
+// Browse returns up to limit messages of named queue by key (name of queue)
+// in queue order, including received and scheduled messages, starting from
+// cursor. Use empty cursor to start from first message and returned next
+// cursor to get next page, the next is empty if there are no more messages.
+func (q *Queue) Browse(key, cursor string, limit int) (items []QueueItem, next string, err error) {
+	if limit <= 0 {
+		err = errors.New("browse limit should be greater than 0")
+		return
+	}
+	var state []byte
+	if cursor != "" {
+		if state, err = base64.RawURLEncoding.DecodeString(cursor); err != nil {
+			return
+		}
+	}
+	recs, state, err := q.backend.Records(q.Context(), key, state, limit)
+	if err != nil {
+		return
+	}
+	for _, rec := range recs {
+		items = append(items, queueItem(rec))
+	}
+	next = base64.RawURLEncoding.EncodeToString(state)
 	return
 }
 
 // Clear remove all records from named queue by key
 func (q *Queue) Clear(key string) (data []byte, err error) {
-	err = q.session.Query(`DELETE FROM `+queueTable+` WHERE key = ?`,key).Exec()
+	err = q.backend.Clear(q.Context(), key)
+	return
+}
+
+// Message is named queue message received with Queue Receive
+type Message struct {
+	q    *Queue
+	key  string
+	rec  QueueRecord
+	Data []byte // Message data
+}
+
+// Key returns named queue key
+func (m *Message) Key() string { return m.key }
+
+// Time returns time the message was added to queue
+func (m *Message) Time() time.Time { return m.rec.Time }
+
+// Receives returns number of the message receives, including this one
+func (m *Message) Receives() int { return m.rec.Receives }
+
+// Visible returns time the message appears in the queue again if it was
+// not acked
+func (m *Message) Visible() time.Time { return m.rec.Visible }
+
+// Ack removes the message from queue
+func (m *Message) Ack() (err error) {
+	ok, err := m.q.backend.Remove(m.q.Context(), m.key, m.rec)
+	if err == nil && !ok {
+		err = ErrReceiptLost
+	}
+	return
+}
+
+// Nack returns the message to queue, it is available to receive at once
+func (m *Message) Nack() (err error) {
+	ok, err := m.q.backend.LockRecord(m.q.Context(), m.key, m.rec, "",
+		time.Time{}, m.rec.Receives)
+	if err == nil && !ok {
+		err = ErrReceiptLost
+	}
 	return
-}
\ No newline at end of file
+}
+
+// ExtendVisibility sets the message visibility timeout to d from now
+func (m *Message) ExtendVisibility(d time.Duration) (err error) {
+	if d <= 0 {
+		err = errors.New("visibility timeout should be greater than 0")
+		return
+	}
+	visible := time.Now().Add(d)
+	ok, err := m.q.backend.LockRecord(m.q.Context(), m.key, m.rec,
+		m.rec.Lock, visible, m.rec.Receives)
+	if err == nil && !ok {
+		err = ErrReceiptLost
+	}
+	if err != nil {
+		return
+	}
+	m.rec.Visible = visible
+	return
+}
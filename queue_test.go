@@ -0,0 +1,416 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Queue tests
+
+package kscdb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueOrder(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	if _, err := cdb.Queue.Get("/test/queue"); err != ErrNotFound {
+		t.Fatalf("get from empty queue: %v, want ErrNotFound", err)
+	}
+
+	cdb.Queue.Set("/test/queue", []byte("1"))
+	cdb.Queue.SetPriority("/test/queue", []byte("high"), 10)
+	cdb.Queue.Set("/test/queue", []byte("2"))
+	cdb.Queue.SetBatch("/test/queue", [][]byte{[]byte("3"), []byte("4")})
+	cdb.Queue.SetPriority("/test/queue", []byte("low"), -1)
+
+	for _, want := range []string{"high", "1", "2", "3", "4", "low"} {
+		data, err := cdb.Queue.Get("/test/queue")
+		if err != nil || string(data) != want {
+			t.Fatalf("get %q, %v, want %q", data, err, want)
+		}
+	}
+}
+
+func TestQueueGetN(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	for i := 0; i < 5; i++ {
+		cdb.Queue.Set("/test/queue", []byte(fmt.Sprint(i)))
+	}
+	values, err := cdb.Queue.GetN("/test/queue", 3)
+	if err != nil || len(values) != 3 || string(values[0]) != "0" || string(values[2]) != "2" {
+		t.Fatalf("get 3 values %q, %v", values, err)
+	}
+	if values, _ = cdb.Queue.GetN("/test/queue", 3); len(values) != 2 {
+		t.Fatalf("get %d last values, want 2", len(values))
+	}
+}
+
+func TestQueueSetBatch(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	// More values than one cql batch
+	values := make([][]byte, 3*queueBatchSize)
+	for i := range values {
+		values[i] = []byte(fmt.Sprint(i))
+	}
+	if err := cdb.Queue.SetBatch("/test/queue", values); err != nil {
+		t.Fatal(err)
+	}
+
+	items, _, err := cdb.Queue.Browse("/test/queue", "", len(values))
+	if err != nil || len(items) != len(values) {
+		t.Fatalf("browse %d items, %v", len(items), err)
+	}
+	for i, item := range items {
+		if string(item.Data) != string(values[i]) {
+			t.Fatalf("item %d is %s, want %s", i, item.Data, values[i])
+		}
+		if !item.Time.Equal(items[0].Time) {
+			t.Fatalf("item %d time %v, want batch time %v", i, item.Time,
+				items[0].Time)
+		}
+	}
+}
+
+func TestQueueParallelGet(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	const n = 200
+	for i := 0; i < n; i++ {
+		cdb.Queue.Set("/test/queue", []byte(fmt.Sprint(i)))
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	got := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				data, err := cdb.Queue.Get("/test/queue")
+				if err == ErrNotFound {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				got[string(data)]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(got) != n {
+		t.Fatalf("got %d values, want %d", len(got), n)
+	}
+	for value, count := range got {
+		if count != 1 {
+			t.Fatalf("value %s got %d times", value, count)
+		}
+	}
+}
+
+func TestQueueReceive(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	cdb.Queue.Set("/test/queue", []byte("1"))
+	cdb.Queue.Set("/test/queue", []byte("2"))
+
+	// Received message is hidden during visibility timeout
+	m, err := cdb.Queue.Receive("/test/queue", 50*time.Millisecond)
+	if err != nil || string(m.Data) != "1" || m.Receives() != 1 {
+		t.Fatalf("receive %+v, %v", m, err)
+	}
+	if m2, _ := cdb.Queue.Receive("/test/queue", time.Second); string(m2.Data) != "2" {
+		t.Fatalf("receive %q, want 2", m2.Data)
+	}
+
+	// Not acked message appears again
+	time.Sleep(60 * time.Millisecond)
+	m3, err := cdb.Queue.Receive("/test/queue", time.Second)
+	if err != nil || string(m3.Data) != "1" || m3.Receives() != 2 {
+		t.Fatalf("receive expired message %+v, %v", m3, err)
+	}
+	if err = m.Ack(); err != ErrReceiptLost {
+		t.Fatalf("ack of expired receipt: %v, want ErrReceiptLost", err)
+	}
+
+	// Nacked message is available at once, acked message is removed
+	if err = m3.Nack(); err != nil {
+		t.Fatal(err)
+	}
+	m4, err := cdb.Queue.Receive("/test/queue", time.Second)
+	if err != nil || string(m4.Data) != "1" {
+		t.Fatalf("receive nacked message %+v, %v", m4, err)
+	}
+	if err = m4.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := cdb.Queue.Len("/test/queue"); n != 1 {
+		t.Fatalf("queue length %d, want 1", n)
+	}
+}
+
+func TestQueueVisibilityTimeout(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+	cdb.LockTTL = 0
+	cdb.VisibilityTimeout = 50 * time.Millisecond
+
+	// Message received by crashed consumer appears again
+	cdb.Queue.Set("/test/queue", []byte("1"))
+	if _, err := cdb.Queue.receive("/test/queue", 1, cdb.Queue.visibility(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cdb.Queue.Get("/test/queue"); err != ErrNotFound {
+		t.Fatalf("get received message: %v, want ErrNotFound", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if data, err := cdb.Queue.Get("/test/queue"); err != nil || string(data) != "1" {
+		t.Fatalf("get %q, %v, want 1", data, err)
+	}
+}
+
+func TestQueueDeadLetter(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+	cdb.MaxReceives = 2
+
+	cdb.Queue.Set("/test/queue", []byte("poison"))
+	var added time.Time
+	for i := 0; i < 2; i++ {
+		m, err := cdb.Queue.Receive("/test/queue", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		added = m.Time()
+		m.Nack()
+	}
+	if _, err := cdb.Queue.Receive("/test/queue", time.Second); err != ErrNotFound {
+		t.Fatalf("receive dead letter: %v, want ErrNotFound", err)
+	}
+
+	items, err := cdb.Queue.DeadLetters("/test/queue", 0)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("dead letters %+v, %v", items, err)
+	}
+	if item := items[0]; string(item.Data) != "poison" || item.Receives != 2 ||
+		!item.Time.Equal(added) {
+		t.Fatalf("dead letter %+v, want receives 2 and time %v", item, added)
+	}
+
+	n, err := cdb.Queue.Redrive("/test/queue")
+	if err != nil || n != 1 {
+		t.Fatalf("redrive %d, %v, want 1", n, err)
+	}
+	m, err := cdb.Queue.Receive("/test/queue", time.Second)
+	if err != nil || m.Receives() != 1 {
+		t.Fatalf("receive redriven message %+v, %v", m, err)
+	}
+}
+
+func TestQueueDelayed(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	cdb.Queue.SetDelayed("/test/queue", []byte("later"), 50*time.Millisecond)
+	cdb.Queue.Set("/test/queue", []byte("now"))
+	if n, _ := cdb.Queue.Scheduled("/test/queue"); n != 1 {
+		t.Fatalf("%d scheduled, want 1", n)
+	}
+	if data, _ := cdb.Queue.Get("/test/queue"); string(data) != "now" {
+		t.Fatalf("get %q, want now", data)
+	}
+	if _, err := cdb.Queue.Get("/test/queue"); err != ErrNotFound {
+		t.Fatalf("get scheduled message: %v, want ErrNotFound", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if data, _ := cdb.Queue.Get("/test/queue"); string(data) != "later" {
+		t.Fatalf("get %q, want later", data)
+	}
+}
+
+func TestQueueMaxWait(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+	cdb.QueueMaxWait = 20 * time.Millisecond
+
+	cdb.Queue.Set("/test/queue", []byte("low"))
+	time.Sleep(30 * time.Millisecond)
+	cdb.Queue.SetPriority("/test/queue", []byte("high"), 10)
+	if data, _ := cdb.Queue.Get("/test/queue"); string(data) != "low" {
+		t.Fatalf("get %q, want starving low", data)
+	}
+}
+
+func TestQueueBrowse(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+
+	for i := 0; i < 5; i++ {
+		cdb.Queue.Set("/test/queue", []byte(fmt.Sprint(i)))
+	}
+	if item, err := cdb.Queue.Peek("/test/queue"); err != nil || string(item.Data) != "0" {
+		t.Fatalf("peek %+v, %v", item, err)
+	}
+
+	var got []string
+	var cursor string
+	for pages := 0; ; pages++ {
+		items, next, err := cdb.Queue.Browse("/test/queue", cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range items {
+			got = append(got, string(item.Data))
+		}
+		if next == "" {
+			break
+		}
+		if pages > 5 {
+			t.Fatal("browse does not stop")
+		}
+		cursor = next
+	}
+	if fmt.Sprint(got) != "[0 1 2 3 4]" {
+		t.Fatalf("browse %v", got)
+	}
+}
+
+func TestQueueSubscribe(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+	cdb.PollBackoff = Backoff{Min: time.Millisecond, Max: 5 * time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := cdb.Queue.Subscribe(ctx, "/test/queue", 2)
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			cdb.Queue.Set("/test/queue", []byte(fmt.Sprint(i)))
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case m := <-ch:
+			if err := m.Ack(); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d not received", i)
+		}
+	}
+	cancel()
+	for range ch {
+	}
+	if n, _ := cdb.Queue.Len("/test/queue"); n != 0 {
+		t.Fatalf("queue length %d after ack, want 0", n)
+	}
+}
+
+func TestQueueSubscribeSlowConsumer(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+	cdb.VisibilityTimeout = 100 * time.Millisecond
+	cdb.PollBackoff = Backoff{Min: time.Millisecond, Max: 5 * time.Millisecond}
+
+	const n = 6
+	for i := 0; i < n; i++ {
+		cdb.Queue.Set("/test/queue", []byte(fmt.Sprint(i)))
+	}
+
+	// Consumer is faster than visibility timeout but slower than workers,
+	// so received messages wait to be taken
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := cdb.Queue.Subscribe(ctx, "/test/queue", 3)
+	got := make(map[string]int)
+	for i := 0; i < n; i++ {
+		select {
+		case m := <-ch:
+			got[string(m.Data)]++
+			time.Sleep(40 * time.Millisecond)
+			if err := m.Ack(); err != nil {
+				t.Fatalf("ack message %s: %v", m.Data, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d not received", i)
+		}
+	}
+	cancel()
+	for m := range ch {
+		t.Fatalf("message %s received after all messages", m.Data)
+	}
+
+	if len(got) != n {
+		t.Fatalf("got %d messages, want %d", len(got), n)
+	}
+	for data, count := range got {
+		if count != 1 {
+			t.Fatalf("message %s received %d times", data, count)
+		}
+	}
+}
+
+func TestQueueWait(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+	cdb.PollBackoff = Backoff{Min: time.Millisecond, Max: 5 * time.Millisecond}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cdb.Queue.Set("/test/queue", []byte("1"))
+	}()
+	data, err := cdb.Queue.Wait(context.Background(), "/test/queue")
+	if err != nil || string(data) != "1" {
+		t.Fatalf("wait %q, %v, want 1", data, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = cdb.Queue.Wait(ctx, "/test/queue"); err != context.DeadlineExceeded {
+		t.Fatalf("wait empty queue: %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestQueueSubscribeContext(t *testing.T) {
+	cdb := newTestKscdb()
+	defer cdb.Close()
+	cdb.PollBackoff = Backoff{Min: time.Millisecond, Max: 5 * time.Millisecond}
+	cdb.Queue.Set("/test/queue", []byte("1"))
+
+	// Worker receives the message and waits for consumer
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := cdb.Queue.Subscribe(ctx, "/test/queue", 1)
+	for {
+		if _, err := cdb.Queue.Peek("/test/queue"); err == ErrNotFound {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Not delivered message is returned to queue when the context is done
+	cancel()
+	for m := range ch {
+		t.Fatalf("message %s delivered after cancel", m.Data)
+	}
+	item, err := cdb.Queue.Peek("/test/queue")
+	if err != nil || string(item.Data) != "1" || item.Locked {
+		t.Fatalf("peek %+v, %v, want nacked message", item, err)
+	}
+}
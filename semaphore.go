@@ -0,0 +1,142 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Distributed counting semaphore module
+
+package kscdb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrNoPermits is returned by TryAcquire when all semaphore permits are held
+var ErrNoPermits = errors.New("no free semaphore permits")
+
+// Semaphore is distributed counting semaphore: at most capacity holders may
+// acquire its permits together. Every permit has holder id (like lockid of
+// Lock) and expires after TTL if it was not released or renewed, so crashed
+// holder does not keep the permit forever.
+type Semaphore struct {
+	cdb      *Kscdb
+	name     string
+	capacity int
+
+	// Permit time to live, permits never expire if 0. Set to kscdb LockTTL
+	// by Kscdb.Semaphore.
+	TTL time.Duration
+}
+
+// Semaphore creates semaphore with name and capacity
+func (cdb *Kscdb) Semaphore(name string, capacity int) *Semaphore {
+	return &Semaphore{cdb: cdb, name: name, capacity: capacity, TTL: cdb.LockTTL}
+}
+
+// Name returns semaphore name
+func (s *Semaphore) Name() string { return s.name }
+
+// Capacity returns semaphore capacity
+func (s *Semaphore) Capacity() int { return s.capacity }
+
+// Acquire acquires semaphore permit. It waits until the permit is acquired,
+// kscdb LockBackoff max attempts exceeded or ctx is done. Returns permit
+// holder id used in Renew and Release.
+func (s *Semaphore) Acquire(ctx context.Context) (permit string, err error) {
+	if err = s.check(); err != nil {
+		return
+	}
+
+	// Create UUID
+	permit = uuid.New().String()
+
+	cdb := s.cdb.WithContext(ctx)
+	err = cdb.retry("Semaphore", s.name, permit, nil, func() (bool, error) {
+		return cdb.backend.AcquirePermit(ctx, s.name, permit, s.capacity,
+			s.expires())
+	})
+	return
+}
+
+// TryAcquire makes single attempt to acquire semaphore permit. It returns
+// ErrNoPermits if all permits are held by others.
+func (s *Semaphore) TryAcquire() (permit string, err error) {
+	if err = s.check(); err != nil {
+		return
+	}
+
+	// Create UUID
+	permit = uuid.New().String()
+
+	ok, err := s.cdb.backend.AcquirePermit(s.cdb.Context(), s.name, permit,
+		s.capacity, s.expires())
+	if err == nil && !ok {
+		err = ErrNoPermits
+	}
+	return
+}
+
+// Lease acquires semaphore permit and starts keep-alive goroutine which
+// renews it every TTL/3 while the lease is not released or lost, see
+// Kscdb.Lease. It waits until the permit is acquired, see Acquire. The
+// lease ID is the permit holder id.
+func (s *Semaphore) Lease(ctx context.Context) (l *Lease, err error) {
+	ttl := s.TTL
+	if ttl <= 0 {
+		err = errors.New("semaphore lease ttl should be greater than 0")
+		return
+	}
+
+	start := time.Now()
+	permit, err := s.Acquire(ctx)
+	if err != nil {
+		return
+	}
+
+	name, backend := s.name, s.cdb.backend
+	l = newLease(s.cdb, name, permit, 0, ttl, start,
+		func(ctx context.Context, expires time.Time) (bool, error) {
+			return backend.RenewPermit(ctx, name, permit, expires)
+		},
+		func(ctx context.Context) (bool, error) {
+			return true, backend.ReleasePermit(ctx, name, permit)
+		},
+	)
+	return
+}
+
+// Renew extends the permit to TTL from now. It returns ErrLeaseLost if the
+// permit expired or was not acquired.
+func (s *Semaphore) Renew(permit string) (err error) {
+	ok, err := s.cdb.backend.RenewPermit(s.cdb.Context(), s.name, permit,
+		s.expires())
+	if err == nil && !ok {
+		err = ErrLeaseLost
+	}
+	return
+}
+
+// Release releases the permit
+func (s *Semaphore) Release(permit string) error {
+	// Don't use kscdb receiver context, see Unlock
+	return s.cdb.backend.ReleasePermit(context.Background(), s.name, permit)
+}
+
+// check checks semaphore capacity
+func (s *Semaphore) check() error {
+	if s.capacity <= 0 {
+		return errors.New("semaphore capacity should be greater than 0")
+	}
+	return nil
+}
+
+// expires returns permit expiration time acquired now
+func (s *Semaphore) expires() (expires time.Time) {
+	if s.TTL > 0 {
+		expires = time.Now().Add(s.TTL)
+	}
+	return
+}
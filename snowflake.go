@@ -0,0 +1,238 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Snowflake ID generator module
+
+package kscdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Snowflake ID layout: 41 bits of milliseconds since SnowflakeEpoch, 10 bits
+// of worker number and 12 bits of sequence number in the millisecond
+const (
+	SnowflakeWorkerBits   = 10
+	SnowflakeSequenceBits = 12
+
+	MaxSnowflakeWorkers  = 1 << SnowflakeWorkerBits
+	maxSnowflakeSequence = 1<<SnowflakeSequenceBits - 1
+)
+
+// SnowflakeEpoch is start time of Snowflake IDs
+var SnowflakeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Snowflake errors
+var (
+	ErrClockRegression = errors.New("clock moved backwards")
+	ErrNoWorkers       = errors.New("all snowflake worker numbers are claimed")
+)
+
+// Snowflake generates 64-bit time ordered IDs locally. Every process claims
+// unique worker number on start, it is held by renewable lease while the
+// generator is not closed. The generator refuses to issue IDs if the lease
+// is lost or the clock moved backwards. It is safe for concurrent use.
+type Snowflake struct {
+	cdb    *Kscdb
+	name   string
+	key    string // Worker number lease and saved milliseconds key
+	worker int64
+	lease  *Lease
+
+	mu       sync.Mutex
+	last     int64 // Last ID milliseconds since SnowflakeEpoch
+	sequence int64 // Last ID sequence
+	saved    int64 // Milliseconds saved in the map, see save
+	previous int64 // Milliseconds saved by previous holder, see restore
+}
+
+// snowflakeSaveAhead is number of milliseconds saved ahead of issued IDs
+const snowflakeSaveAhead = int64(time.Second / time.Millisecond)
+
+// Snowflake creates Snowflake ID generator with name. It claims free worker
+// number of the name with lease time to live ttl. Claimed numbers are read
+// with one request and only free numbers are tried, starting from next
+// value of name+"/workers" ID to spread processes between numbers.
+//
+// The generator saves milliseconds of issued IDs in the Map by worker number
+// key, up to one second ahead. Generator which claims the number after
+// previous holder issues IDs after saved milliseconds: it waits until the
+// clock passes them, or returns ErrClockRegression if the clock is behind
+// them more than one second, so the clock moved backwards.
+func (cdb *Kscdb) Snowflake(name string, ttl time.Duration) (s *Snowflake, err error) {
+
+	start, err := cdb.ID.NextInt64(name + "/workers")
+	if err != nil {
+		return
+	}
+
+	// Read claimed worker numbers
+	prefix := name + "/worker/"
+	locks, err := cdb.ListLocks(prefix)
+	if err != nil {
+		return
+	}
+	claimed := make(map[string]bool, len(locks))
+	for _, info := range locks {
+		if info.Holder != "" {
+			claimed[info.Key] = true
+		}
+	}
+
+	// Make single attempt to lock every free worker number
+	c := cdb.WithContext(cdb.Context())
+	c.LockBackoff = Backoff{MaxAttempts: 1}
+	for i := int64(0); i < MaxSnowflakeWorkers; i++ {
+		worker := (start + i) % MaxSnowflakeWorkers
+		key := fmt.Sprintf("%s%d", prefix, worker)
+		if claimed[key] {
+			continue
+		}
+		var lease *Lease
+		lease, err = c.Lease(key, ttl)
+		switch err {
+		case nil:
+			s = &Snowflake{
+				cdb:    cdb.WithContext(context.Background()),
+				name:   name,
+				key:    key,
+				worker: worker,
+				lease:  lease,
+			}
+			if err = s.restore(); err != nil {
+				lease.Release()
+				s = nil
+			}
+			return
+		case ErrMaxAttempts:
+			continue
+		default:
+			return
+		}
+	}
+	err = ErrNoWorkers
+	return
+}
+
+// Name returns generator name
+func (s *Snowflake) Name() string { return s.name }
+
+// Worker returns claimed worker number
+func (s *Snowflake) Worker() int64 { return s.worker }
+
+// Next returns next ID. It returns ErrLeaseLost if worker number lease is
+// lost and ErrClockRegression if the clock moved backwards since last ID or
+// since IDs of previous holder of the worker number.
+func (s *Snowflake) Next() (id int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if !s.lease.valid(now) {
+		err = ErrLeaseLost
+		return
+	}
+
+	ms := now.Sub(SnowflakeEpoch).Milliseconds()
+	switch {
+	case ms < s.last, ms < s.previous-snowflakeSaveAhead:
+		err = ErrClockRegression
+		return
+	case ms <= s.previous:
+		// Previous holder might issue IDs up to saved ahead milliseconds
+		ms, s.sequence = waitAfter(s.previous), 0
+	case ms == s.last:
+		s.sequence = (s.sequence + 1) & maxSnowflakeSequence
+		if s.sequence == 0 {
+			// Sequence overflow, wait next millisecond
+			ms = waitAfter(s.last)
+		}
+	default:
+		s.sequence = 0
+	}
+
+	// Save milliseconds ahead before issuing IDs after saved ones
+	if ms > s.saved {
+		if err = s.save(ms + snowflakeSaveAhead); err != nil {
+			return
+		}
+	}
+	s.last = ms
+
+	id = ms<<(SnowflakeWorkerBits+SnowflakeSequenceBits) |
+		s.worker<<SnowflakeSequenceBits | s.sequence
+	return
+}
+
+// Close saves milliseconds of last issued ID and releases worker number
+// lease
+func (s *Snowflake) Close() (err error) {
+	s.mu.Lock()
+	if s.last > 0 && s.lease.valid(time.Now()) {
+		err = s.save(s.last)
+	}
+	s.mu.Unlock()
+
+	if errRelease := s.lease.Release(); err == nil {
+		err = errRelease
+	}
+	return
+}
+
+// waitAfter waits until milliseconds since SnowflakeEpoch are greater than
+// ms and returns them
+func waitAfter(ms int64) (now int64) {
+	for {
+		if now = time.Since(SnowflakeEpoch).Milliseconds(); now > ms {
+			return
+		}
+		time.Sleep(time.Until(SnowflakeEpoch.Add(
+			time.Duration(ms+1) * time.Millisecond)))
+	}
+}
+
+// restore reads milliseconds saved by previous holder of the worker number,
+// IDs are issued after them
+func (s *Snowflake) restore() (err error) {
+	data, err := s.cdb.Map.Get(s.key)
+	if err == ErrNotFound {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	saved, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return
+	}
+	s.previous, s.saved = saved, saved
+	return
+}
+
+// save saves milliseconds ms of the worker number with lease fencing token,
+// the s.mu should be locked
+func (s *Snowflake) save(ms int64) (err error) {
+	err = s.cdb.Map.Set(s.key, []byte(strconv.FormatInt(ms, 10)),
+		WithFence(s.lease.Token()))
+	if err != nil {
+		return
+	}
+	s.saved = ms
+	return
+}
+
+// ParseSnowflake returns time, worker and sequence numbers of Snowflake ID
+func ParseSnowflake(id int64) (t time.Time, worker, sequence int64) {
+	ms := id >> (SnowflakeWorkerBits + SnowflakeSequenceBits)
+	t = SnowflakeEpoch.Add(time.Duration(ms) * time.Millisecond)
+	worker = id >> SnowflakeSequenceBits & (MaxSnowflakeWorkers - 1)
+	sequence = id & maxSnowflakeSequence
+	return
+}
@@ -0,0 +1,64 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Sortable UUID version 7 module
+
+package kscdb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// uuid7 is UUID version 7 generator state
+var uuid7 struct {
+	mu       sync.Mutex
+	last     int64  // Last UUID milliseconds
+	sequence uint16 // Last UUID sequence in the millisecond
+}
+
+// NewUUIDv7 returns time ordered UUID version 7 (RFC 9562). It contains unix
+// time in milliseconds followed by 12-bit sequence and random bits. UUIDs
+// created by this process increase monotonically, also within the same
+// millisecond, and their strings sort in the same order. Use it to build
+// time ordered keys:
+//
+//	key := "/events/" + kscdb.NewUUIDv7().String()
+func NewUUIDv7() (u uuid.UUID) {
+	rand.Read(u[8:])
+
+	uuid7.mu.Lock()
+	ms := time.Now().UnixMilli()
+	if ms > uuid7.last {
+		uuid7.last, uuid7.sequence = ms, 0
+	} else {
+		// Same millisecond or clock moved backwards, increment sequence and
+		// move to next millisecond on sequence overflow
+		uuid7.sequence++
+		if uuid7.sequence > 0xfff {
+			uuid7.last, uuid7.sequence = uuid7.last+1, 0
+		}
+	}
+	ms, sequence := uuid7.last, uuid7.sequence
+	uuid7.mu.Unlock()
+
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(ms))
+	copy(u[:6], b[2:])
+	u[6] = 0x70 | byte(sequence>>8) // Version 7
+	u[7] = byte(sequence)
+	u[8] = 0x80 | u[8]&0x3f // RFC 4122 variant
+	return
+}
+
+// UUIDv7Time returns time of UUID version 7
+func UUIDv7Time(u uuid.UUID) time.Time {
+	var b [8]byte
+	copy(b[2:], u[:6])
+	return time.UnixMilli(int64(binary.BigEndian.Uint64(b[:])))
+}
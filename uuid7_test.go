@@ -0,0 +1,43 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Sortable UUID version 7 tests
+
+package kscdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUUIDv7Order(t *testing.T) {
+	// Many UUIDs are created in the same millisecond
+	const n = 10000
+	prev := NewUUIDv7()
+	for i := 0; i < n; i++ {
+		u := NewUUIDv7()
+		if u.String() <= prev.String() {
+			t.Fatalf("UUID %s not greater than previous %s", u, prev)
+		}
+		if u.Version() != 7 {
+			t.Fatalf("UUID %s version %d, want 7", u, u.Version())
+		}
+		prev = u
+	}
+}
+
+func TestUUIDv7Time(t *testing.T) {
+	// Let the clock pass milliseconds moved ahead by sequence overflows in
+	// other tests
+	time.Sleep(10 * time.Millisecond)
+
+	before := time.Now().Truncate(time.Millisecond)
+	u := NewUUIDv7()
+	after := time.Now()
+
+	ut := UUIDv7Time(u)
+	if ut.Before(before) || ut.After(after) {
+		t.Fatalf("UUID time %v not in [%v, %v]", ut, before, after)
+	}
+}